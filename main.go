@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"math/rand"
 	"os"
@@ -21,22 +20,48 @@ var WorkerName = flag.String("worker-name", "", "the unique name of this worker"
 var scriptList = flag.String("scripts", "", "comma delimited list of scripts to run")
 var cpuThreshold = flag.Float64("cpu-threshold", 1, "the load before unhealthy")
 var memThreshold = flag.Float64("mem-threshold", 90.0, "max memory usage percent before unhealthy")
-var healthInterval = flag.Duration("health-interval", 5, "Seconds delay for health check")
+var healthInterval = flag.Duration("health-interval", 5*time.Second, "Delay between health checks")
 var host = flag.Bool("host", false, "Allow this worker to be an http host.")
 var hostPort = flag.String("host-port", "9999", "HTTP port of worker.")
 var healthPort = flag.String("health-port", "8787", "Port to run health metrics on")
+var apiPort = flag.String("api-port", "", "Port to serve the cluster management API on, off if empty")
+var apiToken = flag.String("api-token", "", "Bearer token the API port requires, none if empty")
 var configFile = flag.String("config", "", "Config file with worker settings")
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "How long to wait for threads, jobs and requests to finish when shutting down")
+var labels = flag.String("labels", "", "Comma delimited name=value labels threads and jobs can select workers by")
+var maxThreads = flag.Int("max-threads", 0, "Most thread weight this worker will run, 0 for no limit")
+var logFormat = flag.String("log-format", "text", "Format of the worker's log, text or json")
+var reconcileInterval = flag.Duration("reconcile-interval", 5*time.Second, "Delay between checks for work when no cluster events arrive")
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	var ctx = context.Background()
 	log.SetLevel(log.InfoLevel)
 
 	flag.Parse()
-	w, err := worker.Create(*configFile, *redisAddr, *redisPassword, *cluster, *WorkerName, *scriptList, *host, *hostPort, *healthPort)
+	if *logFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	w, err := worker.Create(worker.Options{
+		ConfigFile:     *configFile,
+		RedisAddr:      *redisAddr,
+		RedisPassword:  *redisPassword,
+		Cluster:        *cluster,
+		WorkerName:     *WorkerName,
+		ScriptList:     *scriptList,
+		Host:           *host,
+		HostPort:       *hostPort,
+		HealthPort:     *healthPort,
+		APIPort:        *apiPort,
+		APIToken:       *apiToken,
+		CPUThreshold:   *cpuThreshold,
+		MemThreshold:   *memThreshold,
+		HealthInterval: *healthInterval,
+		Labels:         *labels,
+		MaxThreads:     *maxThreads,
+	})
 
 	//Capture sigterm
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -48,18 +73,18 @@ func main() {
 		log.Debug("worker Started")
 		//handle creating new threads.
 		for worker.IsEnabled(w) {
-			if w.Healthy {
+			worker.Heartbeat(w)
+			worker.Elect(w)
+			worker.CheckWorkers(w)
+			if worker.IsHealthy(w) {
 				worker.CheckThreads(w)
 				worker.CheckJobs(w)
 			}
-			w.Client.HSet(ctx, w.Cluster+":workers:"+w.WorkerName, "Heartbeat", time.Now().UnixNano())
-			time.Sleep(time.Second)
+			w.WaitForWork(*reconcileInterval)
 		}
 		log.Info("Shutting down.")
-		if w.Client != nil {
-			defer w.Client.HSet(ctx, w.Cluster+":workers:"+w.WorkerName, "State", "offline")
-			defer log.Debug("worker Stopped")
-		}
+		w.Drain(*drainTimeout)
+		log.Debug("worker Stopped")
 	} else {
 		log.WithError(err).Error("Failed to start worker.")
 	}
@@ -0,0 +1,264 @@
+package worker
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultListCount is how many entries list routes return without ?count=.
+const defaultListCount = 20
+
+// registerReadAPI adds the routes that only read cluster state to the health
+// server.  Anything that changes the cluster stays off the probe port.
+func registerReadAPI(w *worker, mux *http.ServeMux) {
+	mux.HandleFunc("/versions", readOnly(w.handleVersions))
+	mux.HandleFunc("/errors", w.handleErrors)
+	mux.HandleFunc("/logs", w.handleLogs)
+	mux.HandleFunc("/runs", w.handleRuns)
+}
+
+// newAPIHandler serves every cluster management route on the API port.  With
+// a token set every request has to carry it as a bearer token.
+func newAPIHandler(w *worker, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/versions", w.handleVersions)
+	mux.HandleFunc("/rollback", w.handleRollback)
+	mux.HandleFunc("/errors", w.handleErrors)
+	mux.HandleFunc("/logs", w.handleLogs)
+	mux.HandleFunc("/runs", w.handleRuns)
+	mux.HandleFunc("/trigger", w.handleTrigger)
+	mux.HandleFunc("/once", w.handleOnce)
+	if token == "" {
+		return mux
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(res, req)
+	})
+}
+
+// readOnly refuses anything but GET so a route can be shared with the health
+// port.
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(res, "Method not allowed, use the API port", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(res, req)
+	}
+}
+
+func writeJSON(res http.ResponseWriter, value interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(value)
+}
+
+// handleVersions lists the versions of ?key= on GET and saves the body as a new
+// version on POST, with optional ?author= and ?message=.
+func (w *worker) handleVersions(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(res, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(res, getVersions(w, key))
+	case http.MethodPost:
+		source, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		version, err := saveSource(w, key, string(source), query.Get("author"), query.Get("message"))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(res, map[string]string{"Version": version})
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRollback makes ?version= the active version of ?key=.
+func (w *worker) handleRollback(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	if err := rollback(w, query.Get("key"), query.Get("version")); err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(res, map[string]string{"Version": query.Get("version")})
+}
+
+// handleTrigger runs the job ?key= now.  A JSON body is passed to the script as
+// job.Params.
+func (w *worker) handleTrigger(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := readParams(req.Body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := triggerJob(w, req.URL.Query().Get("key"), params)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(res, map[string]string{"Run": id})
+}
+
+// handleOnce saves the body as a job ?key= that runs once at ?at= (RFC3339 or
+// milliseconds) or after ?delay=, and then removes itself.  ?params= is JSON
+// passed to the script as job.Params.
+func (w *worker) handleOnce(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	due := time.Now().Add(parseDuration(query.Get("delay")))
+	if at := query.Get("at"); at != "" {
+		if ms, err := strconv.ParseInt(at, 10, 64); err == nil {
+			due = time.Unix(0, ms*int64(time.Millisecond))
+		} else if due, err = time.Parse(time.RFC3339, at); err != nil {
+			http.Error(res, "Invalid at", http.StatusBadRequest)
+			return
+		}
+	}
+	var params map[string]interface{}
+	if query.Get("params") != "" {
+		if err := json.Unmarshal([]byte(query.Get("params")), &params); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	source, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := createOneShotJob(w, query.Get("key"), string(source), due, params)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(res, map[string]string{"Run": id})
+}
+
+// readParams reads an optional JSON object from a request body.
+func readParams(body io.Reader) (map[string]interface{}, error) {
+	payload, err := ioutil.ReadAll(body)
+	if err != nil || len(bytes.TrimSpace(payload)) == 0 {
+		return nil, err
+	}
+	var params map[string]interface{}
+	err = json.Unmarshal(payload, &params)
+	return params, err
+}
+
+// getCount reads ?count= for list routes.
+func getCount(req *http.Request) int64 {
+	count, err := strconv.ParseInt(req.URL.Query().Get("count"), 10, 64)
+	if err != nil || count <= 0 {
+		count = defaultListCount
+	}
+	return count
+}
+
+// handleErrors lists the latest errors of ?key=, up to ?count=.
+func (w *worker) handleErrors(res http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		http.Error(res, "Missing key", http.StatusBadRequest)
+		return
+	}
+	writeJSON(res, getErrors(w, key, getCount(req)))
+}
+
+// handleRuns lists the latest runs of the job ?key=, up to ?count=.
+func (w *worker) handleRuns(res http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		http.Error(res, "Missing key", http.StatusBadRequest)
+		return
+	}
+	writeJSON(res, getRuns(w, key, getCount(req)))
+}
+
+// handleLogs returns the latest ?count= log lines of ?key=.  With ?follow=true
+// it keeps the response open and streams new lines as they are written, one
+// JSON document per line.
+func (w *worker) handleLogs(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(res, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := getLogs(w, key, getCount(req))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if query.Get("follow") != "true" {
+		writeJSON(res, entries)
+		return
+	}
+	if !w.followLogs() {
+		http.Error(res, "Too many log followers", http.StatusServiceUnavailable)
+		return
+	}
+	defer w.unfollowLogs()
+
+	flusher, _ := res.(http.Flusher)
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(res)
+	//Follow on from the last line sent.  No lines means the stream was empty,
+	//so it is read from the start and nothing written meanwhile is missed.
+	lastID := "0-0"
+	for i := range entries {
+		encoder.Encode(entries[i])
+		lastID = entries[i].ID
+	}
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		default:
+		}
+
+		entries, err := tailLogs(w, key, lastID, 5*time.Second)
+		if err != nil {
+			return
+		}
+		for i := range entries {
+			encoder.Encode(entries[i])
+			lastID = entries[i].ID
+		}
+	}
+}
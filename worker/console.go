@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/robertkrimen/otto"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultLogLength = 1000
+
+// How many clients can follow log streams on a worker at once.  Each holds a
+// connection while it waits for new lines.
+const maxLogFollowers = 16
+
+// logEntry is one line a script logged.
+type logEntry struct {
+	ID      string
+	Worker  string
+	Level   string
+	Message string
+	Fields  map[string]interface{} `json:",omitempty"`
+	Time    int64
+}
+
+func logStreamKey(key string) string {
+	return key + ":Logs"
+}
+
+// newConsole builds the console object for a task's VM.  Output goes to the
+// task's log stream and, unless MirrorConsole is "false", to the worker's log.
+// A job run also keeps its output in output for its run history.
+func newConsole(w *worker, key string, output *runOutput) map[string]interface{} {
+	mirror := getTaskSetting(w, key, "MirrorConsole") != "false"
+	length, err := strconv.ParseInt(getTaskSetting(w, key, "LogLength"), 10, 64)
+	if err != nil || length <= 0 {
+		length = defaultLogLength
+	}
+
+	write := func(level log.Level) func(call otto.FunctionCall) otto.Value {
+		return func(call otto.FunctionCall) otto.Value {
+			message := formatConsole(call.ArgumentList)
+			appendLog(w, key, level, message, nil, length)
+			output.write(level, message)
+			if mirror {
+				log.WithFields(log.Fields{"task": key}).Log(level, message)
+			}
+			return otto.UndefinedValue()
+		}
+	}
+
+	return map[string]interface{}{
+		"log":   write(log.InfoLevel),
+		"info":  write(log.InfoLevel),
+		"debug": write(log.DebugLevel),
+		"warn":  write(log.WarnLevel),
+		"error": write(log.ErrorLevel),
+	}
+}
+
+// newLogger builds the structured log object for a task's VM.  Each method
+// takes a message and an optional object of fields.  Lines are tagged with the
+// cluster, worker and task and go to both the worker's log and the task's log
+// stream.
+func newLogger(w *worker, key string) map[string]interface{} {
+	length, err := strconv.ParseInt(getTaskSetting(w, key, "LogLength"), 10, 64)
+	if err != nil || length <= 0 {
+		length = defaultLogLength
+	}
+
+	write := func(level log.Level) func(call otto.FunctionCall) otto.Value {
+		return func(call otto.FunctionCall) otto.Value {
+			message := call.Argument(0).String()
+			fields := log.Fields{}
+			if call.Argument(1).IsObject() {
+				exported, _ := call.Argument(1).Export()
+				if object, ok := exported.(map[string]interface{}); ok {
+					for name, value := range object {
+						fields[name] = value
+					}
+				}
+			}
+			appendLog(w, key, level, message, fields, length)
+
+			fields["cluster"] = w.Cluster
+			fields["worker"] = w.WorkerName
+			fields["task"] = key
+			log.WithFields(fields).Log(level, message)
+			return otto.UndefinedValue()
+		}
+	}
+
+	return map[string]interface{}{
+		"debug": write(log.DebugLevel),
+		"info":  write(log.InfoLevel),
+		"warn":  write(log.WarnLevel),
+		"error": write(log.ErrorLevel),
+	}
+}
+
+// formatConsole joins console arguments the same way otto's console does.
+func formatConsole(arguments []otto.Value) string {
+	output := make([]string, 0, len(arguments))
+	for i := range arguments {
+		output = append(output, arguments[i].String())
+	}
+	return strings.Join(output, " ")
+}
+
+// appendLog adds a line to the capped log stream of a task.
+func appendLog(w *worker, key string, level log.Level, message string, fields log.Fields, length int64) {
+	values := map[string]interface{}{
+		"Worker":  w.WorkerName,
+		"Level":   level.String(),
+		"Message": message,
+		"Time":    time.Now().UnixNano(),
+	}
+	if len(fields) > 0 {
+		encoded, _ := json.Marshal(fields)
+		values["Fields"] = string(encoded)
+	}
+	err := w.Client.XAdd(ctx, &redis.XAddArgs{Stream: logStreamKey(key), MaxLenApprox: length, Values: values}).Err()
+	if err != nil {
+		log.WithError(err).Debug("Error writing log of ", key)
+	}
+}
+
+func toLogEntry(message redis.XMessage) logEntry {
+	entry := logEntry{ID: message.ID}
+	entry.Worker, _ = message.Values["Worker"].(string)
+	entry.Level, _ = message.Values["Level"].(string)
+	entry.Message, _ = message.Values["Message"].(string)
+	if fields, ok := message.Values["Fields"].(string); ok {
+		json.Unmarshal([]byte(fields), &entry.Fields)
+	}
+	if t, ok := message.Values["Time"].(string); ok {
+		entry.Time, _ = strconv.ParseInt(t, 10, 64)
+	}
+	return entry
+}
+
+// getLogs returns up to count of the latest log lines of a task, oldest first.
+func getLogs(w *worker, key string, count int64) ([]logEntry, error) {
+	messages, err := w.Client.XRevRangeN(ctx, logStreamKey(key), "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]logEntry, len(messages))
+	for i := range messages {
+		entries[len(messages)-1-i] = toLogEntry(messages[i])
+	}
+	return entries, nil
+}
+
+// logTailClient returns the client log followers wait on.  It is kept apart
+// from the worker's own client so followers blocked on new lines can't use up
+// the connections threads and jobs need.
+func (w *worker) logTailClient() *redis.Client {
+	w.tailOnce.Do(func() {
+		options := *w.Client.Options()
+		options.PoolSize = maxLogFollowers
+		w.tailClient = redis.NewClient(&options)
+		w.followers = make(chan struct{}, maxLogFollowers)
+	})
+	return w.tailClient
+}
+
+// followLogs takes one of the worker's follower slots.  Returns false if all of
+// them are in use, otherwise the slot is handed back with unfollowLogs.
+func (w *worker) followLogs() bool {
+	w.logTailClient()
+	select {
+	case w.followers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *worker) unfollowLogs() {
+	<-w.followers
+}
+
+// tailLogs waits up to block for log lines of a task newer than lastID.  Use
+// "$" as lastID to only see lines written from now on.
+func tailLogs(w *worker, key string, lastID string, block time.Duration) ([]logEntry, error) {
+	streams, err := w.logTailClient().XRead(ctx, &redis.XReadArgs{Streams: []string{logStreamKey(key), lastID}, Block: block}).Result()
+	if err == redis.Nil {
+		return []logEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]logEntry, 0)
+	for i := range streams {
+		for j := range streams[i].Messages {
+			entries = append(entries, toLogEntry(streams[i].Messages[j]))
+		}
+	}
+	return entries, nil
+}
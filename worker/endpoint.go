@@ -23,8 +23,12 @@ func (em *EndpointMeta) getVM() *otto.Otto {
 	return em.vm
 }
 
+func (em *EndpointMeta) getKey() string {
+	return em.Key
+}
+
 func (em *EndpointMeta) getSource(w *worker) (source string) {
-	source = w.Client.HGet(ctx, em.Key, "Source").Val()
+	source, _ = getActiveSource(w, em.Key)
 	return
 }
 
@@ -35,6 +39,7 @@ func getEndpoint(w *worker, path string) (em *EndpointMeta) {
 		em = nil
 	} else {
 		em.vm = otto.New()
+		em.vm.Interrupt = make(chan func(), 1)
 		applyLibrary(w, em)
 	}
 	///TODO - Add some checks to see if the endpoint is enabled or not.
@@ -42,9 +47,11 @@ func getEndpoint(w *worker, path string) (em *EndpointMeta) {
 }
 
 func (em *EndpointMeta) run(worker *worker, w http.ResponseWriter, r *http.Request) {
-	source := em.getSource(worker)
+	source, version := getActiveSource(worker, em.Key)
 	output := ""
 	if source != "" {
+		timeout := getTaskDuration(worker, em.Key, "Timeout")
+		deadline := time.Now().Add(timeout)
 		b, _ := ioutil.ReadAll(r.Body)
 		errorThrown := false
 		em.vm.Set("request", map[string]interface{}{
@@ -80,14 +87,27 @@ func (em *EndpointMeta) run(worker *worker, w http.ResponseWriter, r *http.Reque
 				s := strings.Split(inputS[i], "?>")
 				script := s[0]
 				afterScript := s[1]
-				_, err := em.vm.Run(script)
+				remaining := time.Duration(0)
+				if timeout > 0 {
+					//Every block shares the time allowed for the request.
+					remaining = time.Until(deadline)
+					if remaining <= 0 {
+						remaining = time.Nanosecond
+					}
+				}
+				_, err := runScript(em.vm, script, remaining)
 
 				if err != nil {
-					worker.Client.HSet(ctx, em.Key, "Error", err.Error())
-					worker.Client.HSet(ctx, em.Key, "ErrorTime", time.Now())
-					log.WithError(err).Error("Syntax error in script.")
+					recordError(worker, em.Key, PHASEREQUEST, version, err)
+					autoRollback(worker, em.Key)
 					errorThrown = true
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					if err == errTimeout {
+						log.Error("Endpoint timed out ", em.Key)
+						http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+					} else {
+						log.WithError(err).Error("Syntax error in script.")
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
 					break
 				}
 
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	log "github.com/sirupsen/logrus"
+)
+
+//Phases a script can fail in
+
+//PHASELOAD running the top level of a script
+const PHASELOAD = "load"
+
+//PHASEINIT running init()
+const PHASEINIT = "init"
+
+//PHASEMAIN running main()
+const PHASEMAIN = "main"
+
+//PHASECLEANUP running cleanup()
+const PHASECLEANUP = "cleanup"
+
+//PHASERUN running a job
+const PHASERUN = "run"
+
+//PHASEREQUEST serving an endpoint request
+const PHASEREQUEST = "request"
+
+//PHASEPARTITIONS running onPartitionsChange()
+const PHASEPARTITIONS = "partitions"
+
+//PHASELEADERSHIP running onLeadershipChange()
+const PHASELEADERSHIP = "leadership"
+
+//Failure types
+
+//EXCEPTION the script threw or failed to parse
+const EXCEPTION = "exception"
+
+//TIMEOUT the script ran longer than it was allowed to
+const TIMEOUT = "timeout"
+
+const defaultErrorHistory = 100
+
+// taskError is one entry in a task's error log.
+type taskError struct {
+	Type    string
+	Error   string
+	Stack   string
+	Worker  string
+	Version string
+	Phase   string
+	Time    int64
+}
+
+func errorLogKey(key string) string {
+	return key + ":Errors"
+}
+
+// recordError adds err to the capped error log of a task and keeps the task's
+// Error and ErrorTime fields pointing at the latest one.
+func recordError(w *worker, key string, phase string, version string, err error) {
+	entry := taskError{Type: EXCEPTION, Error: err.Error(), Worker: w.WorkerName, Version: version,
+		Phase: phase, Time: time.Now().UnixNano()}
+	if err == errTimeout {
+		entry.Type = TIMEOUT
+	}
+	//Otto errors carry the javascript stack trace.
+	if ottoErr, ok := err.(*otto.Error); ok {
+		entry.Stack = ottoErr.String()
+	}
+
+	history, convErr := strconv.Atoi(getTaskSetting(w, key, "ErrorHistory"))
+	if convErr != nil || history <= 0 {
+		history = defaultErrorHistory
+	}
+
+	payload, _ := json.Marshal(entry)
+	w.Client.LPush(ctx, errorLogKey(key), string(payload))
+	w.Client.LTrim(ctx, errorLogKey(key), 0, int64(history-1))
+	w.Client.HSet(ctx, key, "Error", entry.Error)
+	w.Client.HSet(ctx, key, "ErrorType", entry.Type)
+	w.Client.HSet(ctx, key, "ErrorTime", time.Now())
+}
+
+// getErrors returns up to count of the latest errors of a task, newest first.
+func getErrors(w *worker, key string, count int64) []taskError {
+	errs := make([]taskError, 0)
+	entries := w.Client.LRange(ctx, errorLogKey(key), 0, count-1).Val()
+	for i := range entries {
+		var entry taskError
+		if err := json.Unmarshal([]byte(entries[i]), &entry); err != nil {
+			log.WithError(err).Error("Error reading error log of ", key)
+			continue
+		}
+		errs = append(errs, entry)
+	}
+	return errs
+}
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Cluster event types
+
+//THREADCREATED a thread was added to the cluster
+const THREADCREATED = "thread-created"
+
+//THREADSTOPPED a thread was handed back and can be taken
+const THREADSTOPPED = "thread-stopped"
+
+//THREADDISABLED a thread was disabled
+const THREADDISABLED = "thread-disabled"
+
+//SOURCECHANGED the source of a task changed
+const SOURCECHANGED = "source-changed"
+
+//WORKERLEFT a worker left the cluster
+const WORKERLEFT = "worker-left"
+
+//JOBREPLACED a run of a job was replaced by a newer one
+const JOBREPLACED = "job-replaced"
+
+//JOBTRIGGERED a run of a job was queued outside its cron
+const JOBTRIGGERED = "job-triggered"
+
+// event is published on the cluster event channel whenever something happens
+// that other workers should react to right away.
+type event struct {
+	Type   string
+	Key    string
+	Worker string
+	Run    string `json:",omitempty"`
+}
+
+func eventChannel(w *worker) string {
+	return w.Cluster + ":Events"
+}
+
+func publishEvent(w *worker, eventType string, key string) {
+	publishRunEvent(w, eventType, key, "")
+}
+
+// publishRunEvent publishes an event about one run of a job.
+func publishRunEvent(w *worker, eventType string, key string, runID string) {
+	payload, _ := json.Marshal(event{Type: eventType, Key: key, Worker: w.WorkerName, Run: runID})
+	if err := w.Client.Publish(ctx, eventChannel(w), string(payload)).Err(); err != nil {
+		log.WithError(err).Debug("Error publishing event ", eventType)
+	}
+}
+
+// How long to wait before subscribing to cluster events again after a failure.
+const eventRetryBase = time.Second
+const eventRetryMax = 30 * time.Second
+
+// listenForEvents reacts to cluster events until the worker shuts down.  While
+// the subscription is failing the worker falls back to reconciling on its
+// interval and keeps trying to subscribe again, backing off between attempts.
+func (w *worker) listenForEvents() {
+	failures := 0
+	for !w.isShuttingDown() {
+		if w.subscribeToEvents() {
+			failures = 0
+			continue
+		}
+		delay := restartBackoff(failures, eventRetryBase, eventRetryMax)
+		failures++
+		time.Sleep(delay)
+	}
+}
+
+// subscribeToEvents handles cluster events until the subscription ends.
+// Returns false if it couldn't subscribe.
+func (w *worker) subscribeToEvents() bool {
+	pubsub := w.Client.Subscribe(ctx, eventChannel(w))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.WithError(err).Warn("Unable to subscribe to cluster events, polling until it can")
+		return false
+	}
+
+	for message := range pubsub.Channel() {
+		if w.isShuttingDown() {
+			return true
+		}
+		var e event
+		if err := json.Unmarshal([]byte(message.Payload), &e); err != nil {
+			log.WithError(err).Error("Error reading cluster event")
+			continue
+		}
+		w.handleEvent(e)
+	}
+	return true
+}
+
+func (w *worker) handleEvent(e event) {
+	log.Debug("Cluster event ", e.Type, " ", e.Key)
+	switch e.Type {
+	case THREADDISABLED:
+		for _, tm := range localInstances(w, e.Key) {
+			tm.stop(w)
+		}
+	case SOURCECHANGED:
+		for _, tm := range localInstances(w, e.Key) {
+			tm.requestReload()
+		}
+		w.wakeUp()
+	case JOBREPLACED:
+		if jm := localJobs(w)[e.Key]; jm != nil {
+			jm.interruptRun(e.Run)
+		}
+	case THREADCREATED, THREADSTOPPED, WORKERLEFT, JOBTRIGGERED:
+		w.wakeUp()
+	}
+}
+
+// wakeUp makes the worker reconcile without waiting for its interval.
+func (w *worker) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+//WaitForWork Blocks until there is a cluster event to react to or interval passes.
+func (w *worker) WaitForWork(interval time.Duration) {
+	select {
+	case <-w.wake:
+	case <-time.After(interval):
+	}
+}
@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const loadAveragePath = "/proc/loadavg"
+const memoryInfoPath = "/proc/meminfo"
+
+// healthRecovery is how far under its thresholds a critical worker has to drop
+// before it takes work again.  Keeps a worker sitting on the line from flapping.
+const healthRecovery = 0.9
+
+// readLoadAverage returns the one minute load average divided across the cpus.
+func readLoadAverage(path string) (float64, error) {
+	fBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(fBytes))
+	if len(fields) == 0 {
+		return 0, errors.New("empty load average")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// readMemoryUsage returns the percent of memory in use.
+func readMemoryUsage(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err == nil {
+			info[strings.TrimSuffix(fields[0], ":")] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	total := info["MemTotal"]
+	if total == 0 {
+		return 0, errors.New("missing MemTotal")
+	}
+	available, ok := info["MemAvailable"]
+	if !ok {
+		//Older kernels don't report MemAvailable.
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	return (total - available) / total * 100, nil
+}
+
+// evaluateHealth decides if the worker is healthy given the latest sample.  A
+// worker that is already critical has to drop below healthRecovery of each
+// threshold before it counts as healthy again.
+func evaluateHealth(healthy bool, load float64, memory float64, cpuThreshold float64, memThreshold float64) (bool, string) {
+	limit := 1.0
+	if !healthy {
+		limit = healthRecovery
+	}
+
+	reasons := make([]string, 0)
+	if cpuThreshold > 0 && load > cpuThreshold*limit {
+		reasons = append(reasons, fmt.Sprintf("load %.2f over %.2f", load, cpuThreshold*limit))
+	}
+	if memThreshold > 0 && memory > memThreshold*limit {
+		reasons = append(reasons, fmt.Sprintf("memory %.2f%% over %.2f%%", memory, memThreshold*limit))
+	}
+	return len(reasons) == 0, strings.Join(reasons, ", ")
+}
+
+// monitorHealth samples the health of the worker until it shuts down.
+func (w *worker) monitorHealth() {
+	for !w.isShuttingDown() {
+		w.checkHealth()
+		time.Sleep(w.HealthInterval)
+	}
+}
+
+func (w *worker) checkHealth() {
+	load, err := readLoadAverage(loadAveragePath)
+	if err != nil {
+		log.WithError(err).Debug("Unable to read load average")
+		return
+	}
+	memory, err := readMemoryUsage(memoryInfoPath)
+	if err != nil {
+		log.WithError(err).Debug("Unable to read memory usage")
+		return
+	}
+
+	wasHealthy := w.isHealthy()
+	healthy, reason := evaluateHealth(wasHealthy, load, memory, w.CPUThreshold, w.MemThreshold)
+	w.healthMutex.Lock()
+	w.Healthy = healthy
+	w.healthReason, w.loadAverage, w.memoryUsage = reason, load, memory
+	w.healthMutex.Unlock()
+
+	if wasHealthy && !healthy {
+		log.Warn("Worker is critical: ", reason)
+		threads := localThreads(w)
+		for i := range threads {
+			threads[i].stop(w)
+		}
+	} else if !wasHealthy && healthy {
+		log.Info("Worker has recovered")
+		w.wakeUp()
+	}
+
+	w.Client.HMSet(ctx, workerKey(w), "Healthy", strconv.FormatBool(healthy), "HealthReason", reason,
+		"LoadAverage", load, "MemoryUsage", memory, "HealthTime", time.Now().UnixNano())
+}
+
+// isHealthy reports if the worker is healthy enough to run work.
+func (w *worker) isHealthy() bool {
+	w.healthMutex.Lock()
+	defer w.healthMutex.Unlock()
+	return w.Healthy
+}
+
+//IsHealthy Returns if the worker is healthy enough to take work.
+func IsHealthy(w *worker) bool {
+	return w.isHealthy()
+}
+
+// handleHealthz answers as long as the process is serving requests.
+func (w *worker) handleHealthz(res http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(res, "ok")
+}
+
+// ready returns why the worker should not be sent work, or "" if it is ready.
+func (w *worker) ready() string {
+	if w.isShuttingDown() {
+		return "draining"
+	}
+	if !w.isHealthy() {
+		return "unhealthy"
+	}
+	if err := w.Client.Ping(ctx).Err(); err != nil {
+		return "redis unreachable: " + err.Error()
+	}
+	return ""
+}
+
+// handleReadyz fails while the worker is unhealthy, draining or can't reach redis.
+func (w *worker) handleReadyz(res http.ResponseWriter, req *http.Request) {
+	if reason := w.ready(); reason != "" {
+		http.Error(res, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(res, "ok")
+}
+
+// workerStatus is the document served on /status.
+type workerStatus struct {
+	Worker       string
+	Cluster      string
+	Labels       map[string]string
+	Started      int64
+	Uptime       float64
+	Ready        bool
+	NotReady     string `json:",omitempty"`
+	Healthy      bool
+	HealthReason string
+	LoadAverage  float64
+	MemoryUsage  float64
+	Leader       bool
+	Threads      []threadStatus
+	Jobs         []jobStatus
+}
+
+type threadStatus struct {
+	Key     string
+	Version string
+}
+
+type jobStatus struct {
+	Key  string
+	Cron string
+}
+
+// handleStatus describes the worker and the work it owns.
+func (w *worker) handleStatus(res http.ResponseWriter, req *http.Request) {
+	notReady := w.ready()
+	w.healthMutex.Lock()
+	status := workerStatus{Worker: w.WorkerName, Cluster: w.Cluster, Labels: w.Labels, Started: w.started.UnixNano(),
+		Uptime: time.Since(w.started).Seconds(), Ready: notReady == "", NotReady: notReady,
+		Healthy: w.Healthy, HealthReason: w.healthReason, LoadAverage: w.loadAverage,
+		MemoryUsage: w.memoryUsage, Leader: w.isLeader(), Threads: make([]threadStatus, 0), Jobs: make([]jobStatus, 0)}
+	w.healthMutex.Unlock()
+
+	threads := localThreads(w)
+	for key, tm := range threads {
+		if !tm.isStopped() {
+			status.Threads = append(status.Threads, threadStatus{Key: key, Version: tm.version})
+		}
+	}
+	sort.Slice(status.Threads, func(i, j int) bool { return status.Threads[i].Key < status.Threads[j].Key })
+	jobs := localJobs(w)
+	for key, jm := range jobs {
+		if jm.cron != nil {
+			status.Jobs = append(status.Jobs, jobStatus{Key: key, Cron: jm.cronString})
+		}
+	}
+	sort.Slice(status.Jobs, func(i, j int) bool { return status.Jobs[i].Key < status.Jobs[j].Key })
+
+	writeJSON(res, status)
+}
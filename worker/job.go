@@ -2,26 +2,98 @@ package worker
 
 import (
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/robertkrimen/otto"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 )
 
-//JobMeta Struct that represents a job.
+// How long a claimed tick is remembered.  It only has to outlast the time
+// between workers firing the same tick.
+const tickRetention = 10 * time.Minute
+
+// claimJobTickScript claims one scheduled run of a job.  The tick key is set
+// only once so every other worker firing the same tick backs off.  What happens
+// to runs still going depends on the job's concurrency policy.  The new run is
+// added to the job's active runs.
+// KEYS[1] job key, KEYS[2] tick key, KEYS[3] active runs, ARGV[1] worker name,
+// ARGV[2] now in nanoseconds, ARGV[3] how long to keep the tick key in
+// milliseconds, ARGV[4] run id, ARGV[5] concurrency policy.
+// Returns {1, replaced run, its worker, ...} if the caller got the tick, {2} if
+// it got the tick but has to skip it or {0}.
+var claimJobTickScript = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'Status')
+if redis.call('EXISTS', KEYS[1]) == 0 or status == 'disabled' then
+	return {0}
+end
+if not redis.call('SET', KEYS[2], ARGV[1], 'NX', 'PX', ARGV[3]) then
+	return {0}
+end
+local active = redis.call('HGETALL', KEYS[3])
+local result = {1}
+if #active > 0 then
+	if ARGV[5] == 'replace' then
+		redis.call('DEL', KEYS[3])
+		for i = 1, #active do
+			result[#result + 1] = active[i]
+		end
+	elseif ARGV[5] ~= 'allow' then
+		return {2}
+	end
+end
+redis.call('HSET', KEYS[3], ARGV[4], ARGV[1])
+redis.call('HMSET', KEYS[1], 'State', 'running', 'Owner', ARGV[1], 'Heartbeat', ARGV[2])
+return result
+`)
+
+// releaseJobScript ends a run.  Once no runs are left the job is given the
+// state and its owner is cleared.  A run that was replaced or reclaimed leaves
+// the job alone.
+// KEYS[1] job key, KEYS[2] active runs, ARGV[1] run id, ARGV[2] state.
+var releaseJobScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+if redis.call('HLEN', KEYS[2]) == 0 then
+	redis.call('HMSET', KEYS[1], 'State', ARGV[2], 'Owner', '')
+end
+return 1
+`)
+
+//JobMeta Struct that represents a job.  Each run gets its own JobMeta with its
+//own VM, the job's keeps track of the runs going on this worker.
 type JobMeta struct {
 	Key        string
 	Stopped    bool
+	RunID      string
 	vm         *otto.Otto
 	cron       *cron.Cron
 	cronString string
+	runsMutex  sync.Mutex
+	runs       map[string]*JobMeta
+	//Console output of a run, kept with its history.
+	output *runOutput
+	params map[string]interface{}
+}
+
+// activeKey holds the runs of a job going on in the cluster and the worker
+// running each.
+func activeKey(key string) string {
+	return key + ":Active"
 }
 
 func (jm *JobMeta) getVM() *otto.Otto {
 	return jm.vm
 }
 
+func (jm *JobMeta) getKey() string {
+	return jm.Key
+}
+
 func (jm *JobMeta) getStatus(w *worker) (status string) {
 	status = w.Client.HGet(ctx, jm.Key, "Status").Val()
 	return
@@ -38,7 +110,7 @@ func (jm *JobMeta) getState(w *worker) (state string) {
 }
 
 func (jm *JobMeta) getSource(w *worker) (source string) {
-	source = w.Client.HGet(ctx, jm.Key, "Source").Val()
+	source, _ = getActiveSource(w, jm.Key)
 	return
 }
 
@@ -58,67 +130,259 @@ func (jm *JobMeta) getOwner(w *worker) (owner string) {
 func (jm *JobMeta) schedule(w *worker) {
 	if jm.cron == nil || jm.cronString != jm.getCron(w) {
 		log.Info("Setting up job cron for ", jm.Key, " cron: ", jm.getCron(w))
-		jm.cron = newWithSeconds()
-		jm.cron.Start()
-		jm.cron.AddFunc(jm.getCron(w), func() {
-			go jm.run(w)
-		})
+		jm.unschedule()
+		c := newWithSeconds()
+		schedule, err := cronParser.Parse(jm.getCron(w))
+		if err != nil {
+			log.WithError(err).Error("Invalid cron for job ", jm.Key)
+		} else {
+			var id cron.EntryID
+			id = c.Schedule(alignSchedule(schedule), cron.FuncJob(func() {
+				//Every worker fires the tick, the time it was due for tells them
+				//apart so only one of them runs it.
+				scheduled := c.Entry(id).Prev
+				if !w.track() {
+					return
+				}
+				go func() {
+					defer w.running.Done()
+					jm.run(w, scheduled)
+				}()
+			}))
+		}
+		c.Start()
+		jm.cron = c
 		jm.cronString = jm.getCron(w)
 	}
 }
 
+// alignedSchedule fires an @every job on multiples of its interval instead of
+// counting from when the worker started, so every worker's ticks are due at
+// the same times and only one of them claims each.
+type alignedSchedule struct {
+	interval time.Duration
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.interval).Add(s.interval)
+}
+
+// alignSchedule aligns @every schedules, crons already fire at the same times
+// on every worker.
+func alignSchedule(schedule cron.Schedule) cron.Schedule {
+	if every, ok := schedule.(cron.ConstantDelaySchedule); ok {
+		return alignedSchedule{interval: every.Delay}
+	}
+	return schedule
+}
+
+// unschedule stops the job's cron on this worker.
+func (jm *JobMeta) unschedule() {
+	if jm.cron != nil {
+		jm.cron.Stop()
+		jm.cron = nil
+	}
+}
+
+// tickKey marks that a run of a job was claimed.  Runs from the cron are
+// identified by the time they were due.
+func tickKey(key string, runID string) string {
+	return key + ":Ticks:" + runID
+}
+
+// getConcurrencyPolicy returns what to do with runs still going when a tick
+// fires.
+func (jm *JobMeta) getConcurrencyPolicy(w *worker) string {
+	policy := strings.ToLower(getTaskSetting(w, jm.Key, "ConcurrencyPolicy"))
+	if policy != ALLOW && policy != REPLACE {
+		policy = FORBID
+	}
+	return policy
+}
+
+// claimTick takes a run of the job.  Only one worker in the cluster gets it.
+// Returns 1 if it should run, 2 if the policy skips it and 0 otherwise, along
+// with the runs it replaces by worker.
+func (jm *JobMeta) claimTick(w *worker, runID string) (int, map[string]string, error) {
+	keys := []string{jm.Key, tickKey(jm.Key, runID), activeKey(jm.Key)}
+	values, err := claimJobTickScript.Run(ctx, w.Client, keys, w.WorkerName, time.Now().UnixNano(),
+		int64(tickRetention/time.Millisecond), runID, jm.getConcurrencyPolicy(w)).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+	list, _ := values.([]interface{})
+	if len(list) == 0 {
+		return 0, nil, nil
+	}
+	result, _ := list[0].(int64)
+	replaced := make(map[string]string)
+	for i := 1; i+1 < len(list); i += 2 {
+		run, _ := list[i].(string)
+		owner, _ := list[i+1].(string)
+		replaced[run] = owner
+	}
+	return int(result), replaced, nil
+}
+
+// release ends a run and hands the job back once no runs are left.
+func (jm *JobMeta) release(w *worker, runID string, state string) {
+	if err := releaseJobScript.Run(ctx, w.Client, []string{jm.Key, activeKey(jm.Key)}, runID, state).Err(); err != nil {
+		log.WithError(err).Error("Error releasing job ", jm.Key)
+	}
+}
+
+// replace interrupts runs a newer run replaced.  Runs on other workers are
+// told through a cluster event.
+func (jm *JobMeta) replace(w *worker, replaced map[string]string) {
+	for runID, owner := range replaced {
+		log.Info("Replacing run ", runID, " of job ", jm.Key)
+		if owner == w.WorkerName {
+			jm.interruptRun(runID)
+		} else {
+			publishRunEvent(w, JOBREPLACED, jm.Key, runID)
+		}
+	}
+}
+
+// interruptRun stops a run of the job going on this worker.
+func (jm *JobMeta) interruptRun(runID string) {
+	jm.runsMutex.Lock()
+	defer jm.runsMutex.Unlock()
+	if run, ok := jm.runs[runID]; ok {
+		run.Stopped = true
+		interruptVM(run.vm)
+	}
+}
+
+func (jm *JobMeta) addRun(run *JobMeta) {
+	jm.runsMutex.Lock()
+	defer jm.runsMutex.Unlock()
+	if jm.runs == nil {
+		jm.runs = make(map[string]*JobMeta)
+	}
+	jm.runs[run.RunID] = run
+}
+
+func (jm *JobMeta) removeRun(runID string) {
+	jm.runsMutex.Lock()
+	defer jm.runsMutex.Unlock()
+	delete(jm.runs, runID)
+}
+
+// localRuns returns the runs of the job going on this worker.
+func (jm *JobMeta) localRuns() []*JobMeta {
+	jm.runsMutex.Lock()
+	defer jm.runsMutex.Unlock()
+	runs := make([]*JobMeta, 0, len(jm.runs))
+	for _, run := range jm.runs {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
 func (jm *JobMeta) disable(w *worker) {
-	if jm.getOwner(w) == w.WorkerName && !jm.Stopped {
-		log.Info("Disabling thread ", jm.Key)
+	if !jm.Stopped {
+		log.Info("Disabling job ", jm.Key)
 		jm.Stopped = true
-		w.Client.HSet(ctx, jm.Key, "State", STOPPED)
 		w.Client.HSet(ctx, jm.Key, "Status", DISABLED)
-		if jm.vm != nil {
-			jm.vm.Interrupt <- func() {
-				log.Error("Disabled thread")
-				return
-			}
-		}
+		interruptVM(jm.vm)
 	}
 }
 
-func (jm *JobMeta) run(w *worker) {
-	log.Info("Starting job ", jm.Key)
+// abandon interrupts runs that outlived a drain and frees the job for others.
+func (jm *JobMeta) abandon(w *worker) {
+	runs := jm.localRuns()
+	for i := range runs {
+		log.Warn("Abandoning run ", runs[i].RunID, " of job ", jm.Key)
+		runs[i].Stopped = true
+		interruptVM(runs[i].vm)
+		jm.release(w, runs[i].RunID, STOPPED)
+	}
+}
+
+// run runs the job for the tick due at scheduled if this worker claims it.
+func (jm *JobMeta) run(w *worker, scheduled time.Time) {
+	jm.start(w, strconv.FormatInt(scheduled.UnixNano(), 10), scheduled, nil)
+}
+
+// start claims a run of the job and runs it.  params are passed to the script
+// as job.Params.  Returns false if the run was skipped.
+func (jm *JobMeta) start(w *worker, runID string, scheduled time.Time, params map[string]interface{}) bool {
 	if jm.getStatus(w) == DISABLED {
-		jm.cron.Stop()
-		jm.cron = nil
 		log.Info("Job disabled ", jm.Key)
+		return false
+	}
+	if !canPlace(w, getPlacement(w, jm.Key), liveWorkers(w)) {
+		return false
+	}
+	claimed, replaced, err := jm.claimTick(w, runID)
+	if err != nil {
+		log.WithError(err).Error("Error claiming job ", jm.Key)
+		return false
+	}
+	if claimed == 2 {
+		log.Warn("Skipping run of job ", jm.Key, ", the last run is still going")
+		w.metrics.add("hats_job_runs_total", "Times a job was run.", 1, "task", jm.Key, "outcome", SKIPPED)
+		now := time.Now().UnixNano()
+		recordRun(w, jm.Key, jobRun{ID: runID, Scheduled: scheduled.UnixNano(), Start: now, End: now,
+			Worker: w.WorkerName, Outcome: SKIPPED})
+		return false
+	}
+	if claimed != 1 {
+		return false
+	}
+	jm.replace(w, replaced)
+
+	log.Info("Starting job ", jm.Key)
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	run := &JobMeta{Key: jm.Key, RunID: runID, output: &runOutput{}, params: params}
+	run.vm = otto.New()
+	run.vm.Interrupt = make(chan func(), 1)
+	applyLibrary(w, run)
+	jm.addRun(run)
+	history := jobRun{ID: runID, Scheduled: scheduled.UnixNano(), Start: time.Now().UnixNano(), Worker: w.WorkerName,
+		Outcome: SUCCESS}
+	state := STOPPED
+	defer func() {
+		jm.removeRun(runID)
+		history.End = time.Now().UnixNano()
+		history.Output = run.output.String()
+		recordRun(w, jm.Key, history)
+		jm.release(w, runID, state)
+	}()
+
+	source, version := getActiveSource(w, jm.Key)
+	if source == "" {
+		log.Error("Source empty for job ", jm.Key)
+		history.Outcome = FAILURE
+		history.Error = "source empty"
+		return true
 	}
-	if jm.getOwner(w) == "" {
-		jm.Stopped = false
-		w.Client.HSet(ctx, jm.Key, "State", RUNNING)
-		w.Client.HSet(ctx, jm.Key, "Heartbeat", time.Now().UnixNano())
-		w.Client.HSet(ctx, jm.Key, "Owner", w.WorkerName)
-
-		jm.vm = otto.New()
-		jm.vm.Interrupt = make(chan func(), 1)
-		applyLibrary(w, jm)
-		source := jm.getSource(w)
-		if source == "" {
-			log.Error("Source empty for thread ", jm.Key)
-			return
-		}
 
-		//Check one last time to make sure someone didn't beat us.
-		if jm.getOwner(w) == w.WorkerName {
-			//Get whole script in memory.
-			_, err := jm.vm.Run(source)
-			if err != nil {
-				w.Client.HSet(ctx, jm.Key, "State", CRASHED)
-				w.Client.HSet(ctx, jm.Key, "Status", DISABLED)
-				w.Client.HSet(ctx, jm.Key, "Error", err.Error())
-				w.Client.HSet(ctx, jm.Key, "ErrorTime", time.Now())
-				log.WithError(err).Error("Syntax error in script.")
-				return
-			}
-
-			w.Client.HSet(ctx, jm.Key, "State", STOPPED)
-			w.Client.HSet(ctx, jm.Key, "Owner", "")
+	//Get whole script in memory.
+	start := time.Now()
+	value, err := runScript(run.vm, source, getTaskDuration(w, jm.Key, "Timeout"))
+	switch {
+	case err == errInterrupted:
+		history.Outcome = INTERRUPTED
+	case err != nil:
+		history.Outcome = FAILURE
+		history.Error = err.Error()
+	default:
+		history.Result, _ = value.Export()
+	}
+	w.metrics.add("hats_job_runs_total", "Times a job was run.", 1, "task", jm.Key, "outcome", history.Outcome)
+	w.metrics.observe("hats_job_duration_seconds", "Time taken by job runs.", time.Since(start), "task", jm.Key)
+	if history.Outcome == FAILURE {
+		state = CRASHED
+		w.metrics.add("hats_task_crashes_total", "Times a task failed.", 1, "task", jm.Key, "phase", PHASERUN)
+		recordError(w, jm.Key, PHASERUN, version, err)
+		if !autoRollback(w, jm.Key) {
+			w.Client.HSet(ctx, jm.Key, "Status", DISABLED)
 		}
+		log.WithError(err).Error("Syntax error in script.")
 	}
+	return true
 }
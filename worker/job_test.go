@@ -0,0 +1,385 @@
+package worker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func addTestJob(mr *miniredis.Miniredis, key string, source string) {
+	mr.HSet(key, "Source", source)
+	mr.HSet(key, "Status", ENABLED)
+	mr.HSet(key, "State", STOPPED)
+	mr.HSet(key, "Cron", "* * * * * *")
+	mr.SetAdd("TestCluster:Index:Jobs", key)
+}
+
+func TestJobTickRunsOnceAcrossWorkers(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:tick"
+	addTestJob(mr, key, "redis.Do('incr', 'runs')")
+
+	workers := make([]*worker, 5)
+	for i := range workers {
+		workers[i] = newTestWorker(mr, "worker"+strconv.Itoa(i))
+	}
+	shareConnection(mr, workers...)
+	scheduled := time.Now().Truncate(time.Second)
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		w := w
+		jm := &JobMeta{Key: key, Stopped: true}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jm.run(w, scheduled)
+		}()
+	}
+	wg.Wait()
+
+	if runs, _ := mr.Get("runs"); runs != "1" {
+		t.Errorf("Expected the tick to run once, ran %s times", runs)
+	}
+	if mr.HGet(key, "State") != STOPPED || mr.HGet(key, "Owner") != "" {
+		t.Errorf("Job was not released after its run.")
+	}
+
+	//The next tick is free to run.
+	(&JobMeta{Key: key}).run(newTestWorker(mr, "worker0"), scheduled.Add(time.Second))
+	if runs, _ := mr.Get("runs"); runs != "2" {
+		t.Errorf("Expected the next tick to run, ran %s times", runs)
+	}
+}
+
+func TestCrashedJobIsReleased(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:crashing"
+	addTestJob(mr, key, "throw new Error('boom')")
+	w := newTestWorker(mr, "worker")
+
+	(&JobMeta{Key: key}).run(w, time.Now())
+	if mr.HGet(key, "State") != CRASHED || mr.HGet(key, "Owner") != "" {
+		t.Errorf("Crashed job kept its owner, state %s owner %s", mr.HGet(key, "State"), mr.HGet(key, "Owner"))
+	}
+
+	mr.HSet(key, "Status", ENABLED)
+	mr.HSet(key, "Source", "redis.Do('incr', 'runs')")
+	(&JobMeta{Key: key}).run(newTestWorker(mr, "other"), time.Now().Add(time.Second))
+	if runs, _ := mr.Get("runs"); runs != "1" {
+		t.Errorf("Job did not run again after a crash.")
+	}
+}
+
+func TestScheduledJobRunsOncePerTick(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:scheduled"
+	addTestJob(mr, key, "redis.Do('incr', 'runs')")
+
+	workers := []*worker{newTestWorker(mr, "first"), newTestWorker(mr, "second"), newTestWorker(mr, "third")}
+	shareConnection(mr, workers...)
+	for i := range workers {
+		CheckJobs(workers[i])
+	}
+	time.Sleep(2500 * time.Millisecond)
+	for i := range workers {
+		stopTestWorker(workers[i])
+	}
+
+	ticks := 0
+	for _, k := range mr.Keys() {
+		if strings.HasPrefix(k, key+":Ticks:") {
+			ticks++
+		}
+	}
+	runs, _ := mr.Get("runs")
+	if ticks < 2 || runs != strconv.Itoa(ticks) {
+		t.Errorf("Expected one run per tick, got %s runs for %d ticks", runs, ticks)
+	}
+}
+
+func TestForbidSkipsTickWhileRunning(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:forbid"
+	addTestJob(mr, key, "redis.Do('incr', 'runs')")
+	mr.HSet(activeKey(key), "earlier", "other")
+
+	(&JobMeta{Key: key}).run(newTestWorker(mr, "worker"), time.Now())
+	if runs, _ := mr.Get("runs"); runs != "" {
+		t.Errorf("Tick ran while an earlier run was going.")
+	}
+	if mr.HGet(activeKey(key), "earlier") != "other" {
+		t.Errorf("Skipped tick touched the earlier run.")
+	}
+}
+
+func TestAllowOverlapsRuns(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:allow"
+	addTestJob(mr, key, "redis.Do('incr', 'runs')")
+	mr.HSet(key, "ConcurrencyPolicy", "Allow")
+	mr.HSet(key, "State", RUNNING)
+	mr.HSet(activeKey(key), "earlier", "other")
+
+	(&JobMeta{Key: key}).run(newTestWorker(mr, "worker"), time.Now())
+	if runs, _ := mr.Get("runs"); runs != "1" {
+		t.Errorf("Overlapping run did not run.")
+	}
+	if mr.HGet(activeKey(key), "earlier") != "other" || mr.HGet(key, "State") != RUNNING {
+		t.Errorf("Job was released while the earlier run is still going.")
+	}
+}
+
+func TestEveryScheduleTicksLineUpAcrossWorkers(t *testing.T) {
+	schedule, err := cronParser.Parse("@every 2s")
+	if err != nil {
+		t.Fatalf("Error parsing schedule: %v", err)
+	}
+	aligned := alignSchedule(schedule)
+	//Two workers that started a second apart.
+	first := time.Unix(1000, 0)
+	second := time.Unix(1001, 0)
+	if aligned.Next(first) != aligned.Next(second) {
+		t.Errorf("Workers are due at %v and %v", aligned.Next(first), aligned.Next(second))
+	}
+	if next := aligned.Next(aligned.Next(first)); next != time.Unix(1004, 0) {
+		t.Errorf("Expected the tick after to be due at 1004, got %v", next.Unix())
+	}
+
+	cron, _ := cronParser.Parse("*/5 * * * * *")
+	if alignSchedule(cron) != cron {
+		t.Errorf("Cron schedule was changed.")
+	}
+}
+
+func TestReplaceInterruptsRunningRun(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:replace"
+	addTestJob(mr, key, "if (redis.Do('incr', 'runs') == 1) { while (true) {} }")
+	mr.HSet(key, "ConcurrencyPolicy", REPLACE)
+
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	firstJob := &JobMeta{Key: key}
+	first.jobs = map[string]*JobMeta{key: firstJob}
+	done := make(chan struct{})
+	scheduled := time.Now().Truncate(time.Second)
+	go func() {
+		firstJob.run(first, scheduled)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(firstJob.localRuns()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//The next tick lands on another worker, which tells the first to stop.
+	(&JobMeta{Key: key}).run(second, scheduled.Add(time.Second))
+	first.handleEvent(event{Type: JOBREPLACED, Key: key, Run: strconv.FormatInt(scheduled.UnixNano(), 10)})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Replaced run kept going.")
+	}
+
+	if runs, _ := mr.Get("runs"); runs != "2" {
+		t.Errorf("Expected the new run to run, got %s runs", runs)
+	}
+	if mr.HGet(key, "State") != STOPPED || mr.HGet(key, "Owner") != "" || mr.Exists(activeKey(key)) {
+		t.Errorf("Job was not released after the replacing run.")
+	}
+}
+
+func TestJobRunHistory(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:history"
+	addTestJob(mr, key, "console.log('billing', 3, 'customers'); 3 * 2")
+	w := newTestWorker(mr, "worker")
+	scheduled := time.Now().Truncate(time.Second)
+
+	(&JobMeta{Key: key}).run(w, scheduled)
+	mr.HSet(activeKey(key), "earlier", "other")
+	(&JobMeta{Key: key}).run(w, scheduled.Add(time.Second))
+	mr.Del(activeKey(key))
+	mr.HSet(key, "Source", "throw new Error('boom')")
+	(&JobMeta{Key: key}).run(w, scheduled.Add(2*time.Second))
+
+	res := httptest.NewRecorder()
+	w.handleRuns(res, httptest.NewRequest(http.MethodGet, "/runs?key="+key+"&count=2", nil))
+	var runs []jobRun
+	if err := json.Unmarshal(res.Body.Bytes(), &runs); err != nil || len(runs) != 2 {
+		t.Fatalf("Expected the latest 2 runs, got %s", res.Body.String())
+	}
+	if runs[0].Outcome != FAILURE || !strings.Contains(runs[0].Error, "boom") {
+		t.Errorf("Crashed run not recorded: %+v", runs[0])
+	}
+	if runs[1].Outcome != SKIPPED || runs[1].Scheduled != scheduled.Add(time.Second).UnixNano() {
+		t.Errorf("Skipped run not recorded: %+v", runs[1])
+	}
+
+	first := getRuns(w, key, 10)[2]
+	if first.Outcome != SUCCESS || first.Worker != "worker" || first.Output != "INFO billing 3 customers\n" {
+		t.Errorf("Run not recorded: %+v", first)
+	}
+	if result, _ := first.Result.(float64); result != 6 {
+		t.Errorf("Expected the script's result, got %v", first.Result)
+	}
+	if first.Start < first.Scheduled || first.End < first.Start {
+		t.Errorf("Run times out of order: %+v", first)
+	}
+}
+
+func TestTriggeredJobRunsOnceWithParams(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:triggered"
+	addTestJob(mr, key, "redis.Do('incr', 'runs'); redis.Do('set', 'customer', job.Params.customer)")
+	mr.HSet(key, "Cron", "")
+
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	res := httptest.NewRecorder()
+	first.handleTrigger(res, httptest.NewRequest(http.MethodPost, "/trigger?key="+key, strings.NewReader(`{"customer": 42}`)))
+	var triggered map[string]string
+	if err := json.Unmarshal(res.Body.Bytes(), &triggered); err != nil || triggered["Run"] == "" {
+		t.Fatalf("Trigger failed: %s", res.Body.String())
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range []*worker{first, second} {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			CheckJobs(w)
+		}(w)
+	}
+	wg.Wait()
+	first.running.Wait()
+	second.running.Wait()
+
+	if runs, _ := mr.Get("runs"); runs != "1" {
+		t.Errorf("Expected the triggered run to run once, ran %s times", runs)
+	}
+	if customer, _ := mr.Get("customer"); customer != "42" {
+		t.Errorf("Params not passed to the run, got %s", customer)
+	}
+	if runs := getRuns(first, key, 10); len(runs) != 1 || runs[0].ID != triggered["Run"] {
+		t.Errorf("Triggered run not in the run history: %+v", runs)
+	}
+	if mr.Exists("TestCluster:Scheduled") {
+		t.Errorf("Triggered run left in the queue.")
+	}
+}
+
+func TestOneShotJobRunsOnceThenRemovesItself(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	later := "TestCluster:Jobs:later"
+	once := "TestCluster:Jobs:once"
+	if _, err := createOneShotJob(w, later, "redis.Do('incr', 'later')", time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatalf("Error creating job: %v", err)
+	}
+	if _, err := createOneShotJob(w, once, "redis.Do('incr', 'once')", time.Now(), nil); err != nil {
+		t.Fatalf("Error creating job: %v", err)
+	}
+
+	CheckJobs(w)
+	w.running.Wait()
+	CheckJobs(w)
+	w.running.Wait()
+
+	if runs, _ := mr.Get("once"); runs != "1" {
+		t.Errorf("Expected the one-shot job to run once, ran %s times", runs)
+	}
+	if mr.Exists(once) {
+		t.Errorf("One-shot job did not remove itself.")
+	}
+	if ok, _ := mr.IsMember("TestCluster:Index:Jobs", once); ok {
+		t.Errorf("One-shot job left in the index.")
+	}
+	if len(getRuns(w, once, 10)) != 1 {
+		t.Errorf("One-shot job's run history was not kept.")
+	}
+	if runs, _ := mr.Get("later"); runs != "" || !mr.Exists(later) {
+		t.Errorf("Job due later ran early.")
+	}
+}
+
+func TestOneShotJobKeepsExistingJobs(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Jobs:nightly"
+	mr.HSet(key, "Cron", "0 0 * * *")
+	mr.HSet(key, "Status", ENABLED)
+	mr.HSet(key, "Source", "redis.Do('incr', 'nightly')")
+
+	if _, err := createOneShotJob(w, key, "redis.Do('incr', 'once')", time.Now(), nil); err == nil {
+		t.Errorf("Expected an error creating a one-shot job over an existing job.")
+	}
+	if mr.HGet(key, "OneShot") != "" || mr.HGet(key, "Source") != "redis.Do('incr', 'nightly')" {
+		t.Errorf("Existing job was changed.")
+	}
+	if mr.Exists("TestCluster:Scheduled") {
+		t.Errorf("A run was queued for the existing job.")
+	}
+}
+
+func TestSkippedOneShotJobRunsLater(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Jobs:skipped"
+	if _, err := createOneShotJob(w, key, "redis.Do('incr', 'skipped')", time.Now(), nil); err != nil {
+		t.Fatalf("Error creating job: %v", err)
+	}
+	if _, err := triggerJob(w, key, nil); err == nil {
+		t.Errorf("Expected an error triggering a one-shot job.")
+	}
+	mr.HSet(key, "Status", DISABLED)
+
+	checkScheduled(w)
+	w.running.Wait()
+	if runs, _ := mr.Get("skipped"); runs != "" {
+		t.Errorf("Disabled one-shot job ran.")
+	}
+	if !mr.Exists(key) {
+		t.Errorf("One-shot job was removed without running.")
+	}
+
+	//Enabled again while another run holds it, the run is skipped and queued
+	//again.
+	mr.HSet(key, "Status", ENABLED)
+	mr.HSet(key, "State", RUNNING)
+	mr.HSet(activeKey(key), "earlier", "other")
+	checkScheduled(w)
+	w.running.Wait()
+	if runs, _ := mr.Get("skipped"); runs != "" || !mr.Exists(key) {
+		t.Errorf("One-shot job ran over its last run.")
+	}
+	if due, _ := mr.ZMembers("TestCluster:Scheduled"); len(due) != 1 {
+		t.Fatalf("Skipped run was not queued again: %v", due)
+	}
+
+	mr.HSet(key, "State", STOPPED)
+	mr.Del(activeKey(key))
+	checkScheduled(w)
+	w.running.Wait()
+	if runs, _ := mr.Get("skipped"); runs != "1" || mr.Exists(key) {
+		t.Errorf("One-shot job did not run once it could.")
+	}
+}
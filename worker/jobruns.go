@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Job run outcomes
+
+//SUCCESS the run finished without an error
+const SUCCESS = "success"
+
+//FAILURE the script threw or timed out
+const FAILURE = "failure"
+
+//INTERRUPTED the run was replaced, abandoned or disabled before it finished
+const INTERRUPTED = "interrupted"
+
+//SKIPPED the tick was skipped because an earlier run was still going
+const SKIPPED = "skipped"
+
+const defaultRunHistory = 100
+
+// How much console output is kept with a run.
+const maxRunOutput = 64 * 1024
+
+// jobRun is one entry in a job's run history.
+type jobRun struct {
+	ID        string
+	Scheduled int64
+	Start     int64
+	End       int64
+	Worker    string
+	Outcome   string
+	Error     string      `json:",omitempty"`
+	Output    string      `json:",omitempty"`
+	Result    interface{} `json:",omitempty"`
+}
+
+func runHistoryKey(key string) string {
+	return key + ":Runs"
+}
+
+// recordRun adds a run to the capped run history of a job.
+func recordRun(w *worker, key string, run jobRun) {
+	history, err := strconv.Atoi(getTaskSetting(w, key, "RunHistory"))
+	if err != nil || history <= 0 {
+		history = defaultRunHistory
+	}
+
+	payload, err := json.Marshal(run)
+	if err != nil {
+		//The script returned something that can't be written as JSON.
+		run.Result = nil
+		payload, _ = json.Marshal(run)
+	}
+	w.Client.LPush(ctx, runHistoryKey(key), string(payload))
+	w.Client.LTrim(ctx, runHistoryKey(key), 0, int64(history-1))
+}
+
+// getRuns returns up to count of the latest runs of a job, newest first.
+func getRuns(w *worker, key string, count int64) []jobRun {
+	runs := make([]jobRun, 0)
+	entries := w.Client.LRange(ctx, runHistoryKey(key), 0, count-1).Val()
+	for i := range entries {
+		var run jobRun
+		if err := json.Unmarshal([]byte(entries[i]), &run); err != nil {
+			log.WithError(err).Error("Error reading run history of ", key)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// runOutput collects what a job run writes to its console.  Past maxRunOutput
+// the rest is dropped.
+type runOutput struct {
+	mutex     sync.Mutex
+	output    strings.Builder
+	truncated bool
+}
+
+func (o *runOutput) write(level log.Level, message string) {
+	if o == nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	line := strings.ToUpper(level.String()) + " " + message + "\n"
+	if o.output.Len()+len(line) > maxRunOutput {
+		o.truncated = true
+		return
+	}
+	o.output.WriteString(line)
+}
+
+func (o *runOutput) String() string {
+	if o == nil {
+		return ""
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.truncated {
+		return o.output.String() + "...\n"
+	}
+	return o.output.String()
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"sort"
+	"strings"
+)
+
+// parseLabels reads labels written as "name=value,name=value".  A name on its
+// own gets an empty value.
+func parseLabels(value string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) == 2 {
+			labels[name] = strings.TrimSpace(parts[1])
+		} else {
+			labels[name] = ""
+		}
+	}
+	return labels
+}
+
+// encodeLabels writes labels the way parseLabels reads them, sorted by name.
+func encodeLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// matchSelector reports if labels satisfy every term of a selector.  Terms are
+// comma separated and can be "name=value", "name!=value", "name" (the label is
+// set) or "!name" (the label is not set).  An empty selector matches anything.
+func matchSelector(selector string, labels map[string]string) bool {
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if parts := strings.SplitN(term, "!=", 2); len(parts) == 2 {
+			if value, ok := labels[strings.TrimSpace(parts[0])]; ok && value == strings.TrimSpace(parts[1]) {
+				return false
+			}
+			continue
+		}
+		if parts := strings.SplitN(term, "=", 2); len(parts) == 2 {
+			if value, ok := labels[strings.TrimSpace(parts[0])]; !ok || value != strings.TrimSpace(parts[1]) {
+				return false
+			}
+			continue
+		}
+		if strings.HasPrefix(term, "!") {
+			if _, ok := labels[strings.TrimSpace(term[1:])]; ok {
+				return false
+			}
+			continue
+		}
+		if _, ok := labels[term]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultLeaderLease = 15 * time.Second
+
+// electLeaderScript renews the caller's leadership or takes it over when
+// nobody holds it or the leader's lease ran out.  Taking it bumps the fencing
+// token.  Returns the caller's token, or 0 if another worker leads.
+// KEYS[1] leader hash, ARGV[1] worker name, ARGV[2] now in nanoseconds, ARGV[3]
+// lease in nanoseconds.
+var electLeaderScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'Name', 'Token', 'LeaseExpires')
+local now = tonumber(ARGV[2])
+local expires = tonumber(fields[3])
+local held = fields[1] and fields[1] ~= '' and expires ~= nil and expires >= now
+local lease = string.format('%.0f', now + tonumber(ARGV[3]))
+if held and fields[1] == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'LeaseExpires', lease)
+	return tonumber(fields[2])
+end
+if held then
+	return 0
+end
+local token = redis.call('HINCRBY', KEYS[1], 'Token', 1)
+redis.call('HMSET', KEYS[1], 'Name', ARGV[1], 'Since', ARGV[2], 'LeaseExpires', lease)
+return token
+`)
+
+// resignLeaderScript gives up leadership if the caller still holds the token.
+// KEYS[1] leader hash, ARGV[1] worker name, ARGV[2] token.
+var resignLeaderScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'Name', 'Token')
+if fields[1] ~= ARGV[1] or fields[2] ~= ARGV[2] then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'Name', '', 'LeaseExpires', 0)
+return 1
+`)
+
+func leaderKey(w *worker) string {
+	return w.Cluster + ":Leader"
+}
+
+//Elect Takes or renews leadership of the cluster.  The leader does the cluster
+//wide housekeeping so it isn't done by every worker at once.
+func Elect(w *worker) {
+	if !w.isHealthy() || w.isShuttingDown() {
+		Resign(w)
+		return
+	}
+
+	lease := getClusterDuration(w, "LeaderLease", defaultLeaderLease)
+	now := time.Now()
+	token, err := electLeaderScript.Run(ctx, w.Client, []string{leaderKey(w)}, w.WorkerName, now.UnixNano(), int64(lease)).Int64()
+	if err != nil {
+		log.WithError(err).Error("Error electing leader")
+		token = 0
+	}
+	w.setLeader(token, now.Add(lease))
+}
+
+//Resign Gives up leadership so another worker can take over right away.
+func Resign(w *worker) {
+	w.leaderMutex.Lock()
+	token := w.leaderToken
+	w.leaderMutex.Unlock()
+	if token > 0 {
+		if err := resignLeaderScript.Run(ctx, w.Client, []string{leaderKey(w)}, w.WorkerName, token).Err(); err != nil {
+			log.WithError(err).Error("Error resigning leadership")
+		}
+	}
+	w.setLeader(0, time.Time{})
+}
+
+func (w *worker) setLeader(token int64, expires time.Time) {
+	w.leaderMutex.Lock()
+	defer w.leaderMutex.Unlock()
+	if (token > 0) != (w.leaderToken > 0) {
+		if token > 0 {
+			log.Info("Became leader of cluster ", w.Cluster)
+		} else {
+			log.Info("No longer leader of cluster ", w.Cluster)
+		}
+	}
+	w.leaderToken = token
+	w.leaderExpires = expires
+}
+
+// isLeader reports if this worker leads the cluster.  Leadership runs out with
+// the lease even if the worker stalled before it could notice.
+func (w *worker) isLeader() bool {
+	w.leaderMutex.Lock()
+	defer w.leaderMutex.Unlock()
+	return w.leaderToken > 0 && time.Now().Before(w.leaderExpires)
+}
+
+// getLeaderToken returns the fencing token of the current leadership, 0 if
+// this worker isn't leader.
+func (w *worker) getLeaderToken() int64 {
+	if !w.isLeader() {
+		return 0
+	}
+	w.leaderMutex.Lock()
+	defer w.leaderMutex.Unlock()
+	return w.leaderToken
+}
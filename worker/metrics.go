@@ -0,0 +1,228 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of every duration histogram.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	values     map[string]float64
+	histograms map[string]*histogram
+}
+
+// metricsRegistry holds the series this worker exports in the prometheus text
+// format.  Series are keyed by their rendered label set.
+type metricsRegistry struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+func (r *metricsRegistry) family(name string, kind string, help string) *metricFamily {
+	family := r.families[name]
+	if family == nil {
+		family = &metricFamily{name: name, help: help, kind: kind,
+			values: make(map[string]float64), histograms: make(map[string]*histogram)}
+		r.families[name] = family
+	}
+	return family
+}
+
+// add increases a counter by delta.  labels are name, value pairs.
+func (r *metricsRegistry) add(name string, help string, delta float64, labels ...string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.family(name, counterMetric, help).values[formatLabels(labels...)] += delta
+}
+
+// observe records a duration in a histogram.  labels are name, value pairs.
+func (r *metricsRegistry) observe(name string, help string, duration time.Duration, labels ...string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	family := r.family(name, histogramMetric, help)
+	series := formatLabels(labels...)
+	h := family.histograms[series]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		family.histograms[series] = h
+	}
+	seconds := duration.Seconds()
+	for i := range durationBuckets {
+		if seconds <= durationBuckets[i] {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (r *metricsRegistry) write(out io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range names {
+		family := r.families[names[i]]
+		writeHeader(out, family.name, family.kind, family.help)
+		for _, series := range sortedKeys(family.values) {
+			writeSample(out, family.name, series, family.values[series])
+		}
+		for _, series := range sortedHistograms(family.histograms) {
+			writeHistogram(out, family.name, series, family.histograms[series])
+		}
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistograms(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders name, value pairs as a prometheus label set.
+func formatLabels(labels ...string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"=\""+escapeLabel(labels[i+1])+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func writeHeader(out io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(out io.Writer, name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(out, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func writeHistogram(out io.Writer, name string, labels string, h *histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	for i := range durationBuckets {
+		le := strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+		writeSample(out, name+"_bucket", prefix+`le="`+le+`"`, float64(h.buckets[i]))
+	}
+	writeSample(out, name+"_bucket", prefix+`le="+Inf"`, float64(h.count))
+	writeSample(out, name+"_sum", labels, h.sum)
+	writeSample(out, name+"_count", labels, float64(h.count))
+}
+
+// handleMetrics serves the worker's metrics in the prometheus text format.
+func (w *worker) handleMetrics(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	owned := 0
+	threads := localThreads(w)
+	for i := range threads {
+		if !threads[i].isStopped() {
+			owned++
+		}
+	}
+	scheduled := 0
+	jobs := localJobs(w)
+	for i := range jobs {
+		if jobs[i].cron != nil {
+			scheduled++
+		}
+	}
+	healthy := 0
+	if w.isHealthy() {
+		healthy = 1
+	}
+	leader := 0
+	if w.isLeader() {
+		leader = 1
+	}
+
+	writeHeader(res, "hats_worker_threads_owned", gaugeMetric, "Threads this worker is running.")
+	writeSample(res, "hats_worker_threads_owned", "", float64(owned))
+	writeHeader(res, "hats_worker_jobs_scheduled", gaugeMetric, "Jobs this worker has scheduled.")
+	writeSample(res, "hats_worker_jobs_scheduled", "", float64(scheduled))
+	writeHeader(res, "hats_worker_healthy", gaugeMetric, "1 if the worker is healthy enough to take work.")
+	writeSample(res, "hats_worker_healthy", "", float64(healthy))
+	writeHeader(res, "hats_worker_leader", gaugeMetric, "1 if the worker is the cluster's leader.")
+	writeSample(res, "hats_worker_leader", "", float64(leader))
+
+	start := time.Now()
+	if err := w.Client.Ping(ctx).Err(); err == nil {
+		writeHeader(res, "hats_worker_redis_latency_seconds", gaugeMetric, "Round trip time of a redis ping.")
+		writeSample(res, "hats_worker_redis_latency_seconds", "", time.Since(start).Seconds())
+	}
+
+	w.metrics.write(res)
+	writeScriptMetrics(w, res)
+}
+
+// statusRecorder remembers the status an endpoint answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
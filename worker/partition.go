@@ -0,0 +1,243 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+// claimPartitionsScript takes or extends the lease on partitions for an
+// instance.  A partition can be taken when nobody holds it, the caller already
+// holds it or the holder's lease ran out.  Returns the partitions now held.
+// KEYS[1] partition owners, KEYS[2] partition lease expiry, ARGV[1] instance
+// owner, ARGV[2] now in nanoseconds, ARGV[3] lease in nanoseconds, ARGV[4..]
+// partitions.
+var claimPartitionsScript = redis.NewScript(`
+local now = tonumber(ARGV[2])
+local expires = string.format('%.0f', now + tonumber(ARGV[3]))
+local claimed = {}
+for i = 4, #ARGV do
+	local owner = redis.call('HGET', KEYS[1], ARGV[i])
+	local expiry = tonumber(redis.call('HGET', KEYS[2], ARGV[i]))
+	if not owner or owner == ARGV[1] or expiry == nil or expiry < now then
+		redis.call('HSET', KEYS[1], ARGV[i], ARGV[1])
+		redis.call('HSET', KEYS[2], ARGV[i], expires)
+		claimed[#claimed + 1] = ARGV[i]
+	end
+end
+return claimed
+`)
+
+// releasePartitionsScript gives up partitions the instance still holds.
+// KEYS[1] partition owners, KEYS[2] partition lease expiry, ARGV[1] instance
+// owner, ARGV[2..] partitions.
+var releasePartitionsScript = redis.NewScript(`
+for i = 2, #ARGV do
+	if redis.call('HGET', KEYS[1], ARGV[i]) == ARGV[1] then
+		redis.call('HDEL', KEYS[1], ARGV[i])
+		redis.call('HDEL', KEYS[2], ARGV[i])
+	end
+end
+return 1
+`)
+
+func partitionOwnersKey(key string) string {
+	return key + ":Partitions"
+}
+
+func partitionLeasesKey(key string) string {
+	return key + ":Partitions:Leases"
+}
+
+// getPartitionCount returns how many partitions a thread splits its work into,
+// 0 if it isn't partitioned.
+func getPartitionCount(w *worker, key string) int {
+	count, err := w.Client.HGet(ctx, key, "Partitions").Int()
+	if err != nil || count < 0 {
+		return 0
+	}
+	return count
+}
+
+// partitionScore ranks a member for a partition.  Every member computes the
+// same scores so they agree on who owns what without talking to each other.
+func partitionScore(member string, partition int) uint64 {
+	sum := sha1.Sum([]byte(member + "#" + strconv.Itoa(partition)))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// assignPartitions splits partitions among members with rendezvous hashing: a
+// partition goes to the member with the highest score for it.  A member
+// joining or leaving only moves the partitions it gains or had.
+func assignPartitions(members []string, count int) map[string][]int {
+	assignment := make(map[string][]int, len(members))
+	if len(members) == 0 {
+		return assignment
+	}
+	for partition := 0; partition < count; partition++ {
+		best := ""
+		var bestScore uint64
+		for i := range members {
+			score := partitionScore(members[i], partition)
+			if best == "" || score > bestScore || (score == bestScore && members[i] < best) {
+				best, bestScore = members[i], score
+			}
+		}
+		assignment[best] = append(assignment[best], partition)
+	}
+	return assignment
+}
+
+// partitionMembers returns the workers running a live instance of a thread,
+// each with the instance that holds its partitions.  This worker is always a
+// member.
+func (tm *ThreadMeta) partitionMembers(w *worker) map[string]string {
+	members := map[string]string{w.WorkerName: tm.Key}
+	now := time.Now().UnixNano()
+	keys := threadInstanceKeys(w, tm.definition())
+	for i := range keys {
+		fields := w.Client.HMGet(ctx, keys[i], "State", "LeaseExpires", "Owner").Val()
+		state, _ := fields[0].(string)
+		expiresString, _ := fields[1].(string)
+		owner, _ := fields[2].(string)
+		expires, _ := strconv.ParseInt(expiresString, 10, 64)
+		if keys[i] != tm.Key && (state != RUNNING || expires <= now || owner == "") {
+			continue
+		}
+		if keys[i] == tm.Key {
+			owner = w.WorkerName
+		}
+		//A worker running more than one instance holds its partitions in the
+		//first of them.
+		if current, ok := members[owner]; !ok || keys[i] < current {
+			members[owner] = keys[i]
+		}
+	}
+	return members
+}
+
+// updatePartitions works out which partitions this instance should own, hands
+// back the ones it shouldn't and claims the rest.  Partitions are split between
+// the workers running the thread.  A partition still leased by its previous
+// owner is picked up on a later pass.  Returns true if the partitions held
+// changed.
+func (tm *ThreadMeta) updatePartitions(w *worker) bool {
+	count := getPartitionCount(w, tm.definition())
+	held := tm.getPartitions()
+	if count == 0 && len(held) == 0 {
+		return false
+	}
+	members := tm.partitionMembers(w)
+	workers := make([]string, 0, len(members))
+	for name := range members {
+		workers = append(workers, name)
+	}
+	sort.Strings(workers)
+	var wanted []int
+	if members[w.WorkerName] == tm.Key {
+		wanted = assignPartitions(workers, count)[w.WorkerName]
+	}
+
+	unwanted := make([]int, 0)
+	for i := range held {
+		if held[i] >= count || !containsPartition(wanted, held[i]) {
+			unwanted = append(unwanted, held[i])
+		}
+	}
+	tm.releasePartitions(w, unwanted)
+
+	claimed := tm.claimPartitions(w, wanted)
+	changed := len(claimed) != len(held)
+	for i := 0; !changed && i < len(claimed); i++ {
+		changed = claimed[i] != held[i]
+	}
+	tm.setPartitions(claimed)
+	return changed
+}
+
+// renewPartitions extends the leases on the partitions already held.
+func (tm *ThreadMeta) renewPartitions(w *worker) {
+	if held := tm.getPartitions(); len(held) > 0 {
+		tm.claimPartitions(w, held)
+	}
+}
+
+func (tm *ThreadMeta) claimPartitions(w *worker, partitions []int) []int {
+	claimed := make([]int, 0, len(partitions))
+	if len(partitions) == 0 {
+		return claimed
+	}
+	args := []interface{}{tm.partitionOwner(), time.Now().UnixNano(), int64(tm.getLease(w))}
+	for i := range partitions {
+		args = append(args, partitions[i])
+	}
+	keys := []string{partitionOwnersKey(tm.definition()), partitionLeasesKey(tm.definition())}
+	values, err := claimPartitionsScript.Run(ctx, w.Client, keys, args...).Result()
+	if err != nil {
+		log.WithError(err).Error("Error claiming partitions of ", tm.Key)
+		return claimed
+	}
+	list, _ := values.([]interface{})
+	for i := range list {
+		if s, ok := list[i].(string); ok {
+			if partition, err := strconv.Atoi(s); err == nil {
+				claimed = append(claimed, partition)
+			}
+		}
+	}
+	sort.Ints(claimed)
+	return claimed
+}
+
+func (tm *ThreadMeta) releasePartitions(w *worker, partitions []int) {
+	if len(partitions) == 0 {
+		return
+	}
+	args := []interface{}{tm.partitionOwner()}
+	for i := range partitions {
+		args = append(args, partitions[i])
+	}
+	keys := []string{partitionOwnersKey(tm.definition()), partitionLeasesKey(tm.definition())}
+	if err := releasePartitionsScript.Run(ctx, w.Client, keys, args...).Err(); err != nil {
+		log.WithError(err).Error("Error releasing partitions of ", tm.Key)
+	}
+}
+
+// releaseAllPartitions hands back every partition when the thread stops.
+func (tm *ThreadMeta) releaseAllPartitions(w *worker) {
+	tm.releasePartitions(w, tm.getPartitions())
+	tm.setPartitions(nil)
+}
+
+// partitionOwner is what an instance's partition leases are held under.  The
+// fencing token is part of it so a worker that lost the instance can't hand
+// back partitions the new owner already claimed.
+func (tm *ThreadMeta) partitionOwner() string {
+	return tm.Key + "#" + strconv.FormatInt(tm.token, 10)
+}
+
+func (tm *ThreadMeta) getPartitions() []int {
+	tm.partitionsMutex.Lock()
+	defer tm.partitionsMutex.Unlock()
+	return append([]int{}, tm.partitions...)
+}
+
+func (tm *ThreadMeta) setPartitions(partitions []int) {
+	tm.partitionsMutex.Lock()
+	defer tm.partitionsMutex.Unlock()
+	tm.partitions = partitions
+}
+
+func containsPartition(partitions []int, partition int) bool {
+	for i := range partitions {
+		if partitions[i] == partition {
+			return true
+		}
+	}
+	return false
+}
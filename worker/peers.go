@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+//WORKERS index of the workers in a cluster
+const WORKERS = "Workers"
+
+const defaultWorkerTimeout = 30 * time.Second
+const defaultWorkerRetention = 24 * time.Hour
+
+// How many tasks are released per script call when reclaiming a worker, so a
+// large cluster doesn't hold up redis for long.
+const reclaimBatch = 100
+
+// reclaimTasksScript releases the threads and jobs in a batch that a worker
+// whose heartbeat went stale was running.  Released threads get a new fencing
+// token so the dead worker can't carry on if it comes back.  Its job runs are
+// dropped and a job is released once no runs are left.  Nothing happens unless
+// the caller still holds the leader's token and the worker is still stale.
+// KEYS[1] worker hash, KEYS[2] leader hash, KEYS[3..] thread keys, then job
+// keys, then the active runs of each job, ARGV[1] worker name, ARGV[2]
+// heartbeats before this are stale, ARGV[3] number of thread keys, ARGV[4]
+// leader token, ARGV[5] number of job keys.
+var reclaimTasksScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], 'Token') ~= ARGV[4] then
+	return -2
+end
+local fields = redis.call('HMGET', KEYS[1], 'State', 'Heartbeat')
+if fields[1] == 'offline' then
+	return -1
+end
+local heartbeat = tonumber(fields[2])
+if heartbeat ~= nil and heartbeat >= tonumber(ARGV[2]) then
+	return -1
+end
+local threads = tonumber(ARGV[3])
+local jobs = tonumber(ARGV[5])
+local released = 0
+for i = 3, 2 + threads do
+	local task = redis.call('HMGET', KEYS[i], 'Owner', 'State')
+	if task[1] == ARGV[1] and task[2] == 'running' then
+		redis.call('HINCRBY', KEYS[i], 'Token', 1)
+		redis.call('HMSET', KEYS[i], 'State', 'stopped', 'Owner', '', 'LeaseExpires', 0)
+		released = released + 1
+	end
+end
+for i = 3 + threads, 2 + threads + jobs do
+	local active = KEYS[i + jobs]
+	local runs = redis.call('HGETALL', active)
+	for j = 1, #runs, 2 do
+		if runs[j + 1] == ARGV[1] then
+			redis.call('HDEL', active, runs[j])
+		end
+	end
+	local task = redis.call('HMGET', KEYS[i], 'Owner', 'State')
+	if task[1] == ARGV[1] and task[2] == 'running' and redis.call('HLEN', active) == 0 then
+		redis.call('HMSET', KEYS[i], 'State', 'stopped', 'Owner', '')
+		released = released + 1
+	end
+end
+return released
+`)
+
+// markOfflineScript marks a worker whose heartbeat went stale offline once its
+// tasks have been released.  Returns 1 if it was marked, -1 if it is already
+// offline or came back and -2 if the caller is no longer leader.
+// KEYS[1] worker hash, KEYS[2] leader hash, ARGV[1] heartbeats before this are
+// stale, ARGV[2] leader token.
+var markOfflineScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], 'Token') ~= ARGV[2] then
+	return -2
+end
+local fields = redis.call('HMGET', KEYS[1], 'State', 'Heartbeat')
+if fields[1] == 'offline' then
+	return -1
+end
+local heartbeat = tonumber(fields[2])
+if heartbeat ~= nil and heartbeat >= tonumber(ARGV[1]) then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'State', 'offline')
+return 1
+`)
+
+// getClusterDuration reads a cluster wide setting from <cluster>:Settings.
+func getClusterDuration(w *worker, field string, fallback time.Duration) time.Duration {
+	duration := parseDuration(w.Client.HGet(ctx, settingsKey(w), field).Val())
+	if duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+//Heartbeat Records that the worker is alive.
+func Heartbeat(w *worker) {
+	w.Client.HSet(ctx, workerKey(w), "Heartbeat", time.Now().UnixNano())
+	w.Client.SAdd(ctx, indexKey(w, WORKERS), w.WorkerName)
+	publishLoad(w)
+}
+
+//CheckWorkers Looks for workers that stopped sending heartbeats.  Their threads
+//and jobs are released and their records are pruned once old enough.  Only the
+//leader looks after other workers.
+func CheckWorkers(w *worker) {
+	timeout := getClusterDuration(w, "WorkerTimeout", defaultWorkerTimeout)
+	retention := getClusterDuration(w, "WorkerRetention", defaultWorkerRetention)
+	now := time.Now()
+
+	names := w.Client.SMembers(ctx, indexKey(w, WORKERS)).Val()
+	for i := range names {
+		key := w.Cluster + ":workers:" + names[i]
+		fields := w.Client.HMGet(ctx, key, "State", "Heartbeat").Val()
+		state, _ := fields[0].(string)
+		heartbeatString, _ := fields[1].(string)
+		last, _ := strconv.ParseInt(heartbeatString, 10, 64)
+
+		if names[i] == w.WorkerName {
+			//Someone gave up on us while we were stalled.  Our threads have
+			//been fenced off already so just say we are back.
+			if state == OFFLINE && !w.isShuttingDown() {
+				log.Warn("Worker was marked offline by the cluster, coming back online")
+				w.Client.HSet(ctx, key, "State", ONLINE)
+			}
+			continue
+		}
+		if !w.isLeader() {
+			continue
+		}
+
+		switch {
+		case state == "" && fields[1] == nil:
+			w.Client.SRem(ctx, indexKey(w, WORKERS), names[i])
+		case state == OFFLINE:
+			if now.Sub(time.Unix(0, last)) > retention {
+				log.Info("Pruning worker ", names[i])
+				w.Client.Del(ctx, key)
+				w.Client.SRem(ctx, indexKey(w, WORKERS), names[i])
+			}
+		case now.Sub(time.Unix(0, last)) > timeout:
+			reclaimWorker(w, names[i], now.Add(-timeout))
+		}
+	}
+}
+
+// reclaimWorker releases the work of a worker that has not sent a heartbeat
+// since staleBefore.
+func reclaimWorker(w *worker, name string, staleBefore time.Time) {
+	threads := make([]string, 0)
+	definitions := getTaskKeys(w, THREADS)
+	for i := range definitions {
+		threads = append(threads, threadInstanceKeys(w, definitions[i])...)
+	}
+	jobs := getTaskKeys(w, JOBS)
+
+	//The worker is only marked offline once everything is released, so a
+	//leader that dies part way leaves it for the next leader to finish.
+	released := 0
+	for len(threads) > 0 || len(jobs) > 0 {
+		threadCount := len(threads)
+		if threadCount > reclaimBatch {
+			threadCount = reclaimBatch
+		}
+		jobCount := len(jobs)
+		if jobCount > reclaimBatch-threadCount {
+			jobCount = reclaimBatch - threadCount
+		}
+		count := reclaimTasks(w, name, staleBefore, threads[:threadCount], jobs[:jobCount])
+		if count < 0 {
+			return
+		}
+		released += count
+		threads, jobs = threads[threadCount:], jobs[jobCount:]
+	}
+
+	keys := []string{w.Cluster + ":workers:" + name, leaderKey(w)}
+	marked, err := markOfflineScript.Run(ctx, w.Client, keys, staleBefore.UnixNano(), w.getLeaderToken()).Int()
+	if err != nil {
+		log.WithError(err).Error("Error marking ", name, " offline")
+		return
+	}
+	if marked == -2 {
+		log.Warn("Lost leadership before marking ", name, " offline")
+	}
+	if marked != 1 {
+		return
+	}
+	log.Warn("Worker ", name, " stopped sending heartbeats, released ", released, " tasks")
+	publishEvent(w, WORKERLEFT, w.Cluster+":workers:"+name)
+	w.wakeUp()
+}
+
+// reclaimTasks releases a batch of the tasks a stale worker was running.
+// Returns how many were released or -1 if reclaiming should stop.
+func reclaimTasks(w *worker, name string, staleBefore time.Time, threads []string, jobs []string) int {
+	keys := append([]string{w.Cluster + ":workers:" + name, leaderKey(w)}, threads...)
+	keys = append(keys, jobs...)
+	for i := range jobs {
+		keys = append(keys, activeKey(jobs[i]))
+	}
+
+	released, err := reclaimTasksScript.Run(ctx, w.Client, keys, name, staleBefore.UnixNano(), len(threads),
+		w.getLeaderToken(), len(jobs)).Int()
+	if err != nil {
+		log.WithError(err).Error("Error reclaiming work of ", name)
+		return -1
+	}
+	if released == -2 {
+		log.Warn("Lost leadership before reclaiming work of ", name)
+		return -1
+	}
+	return released
+}
+
+// peer is what a live worker advertises in its hash.
+type peer struct {
+	Name       string
+	Labels     map[string]string
+	Load       int
+	MaxThreads int
+}
+
+// liveWorkers returns the workers that can take work right now: online,
+// enabled, healthy and with a fresh heartbeat.
+func liveWorkers(w *worker) map[string]peer {
+	timeout := getClusterDuration(w, "WorkerTimeout", defaultWorkerTimeout)
+	peers := make(map[string]peer)
+	names := w.Client.SMembers(ctx, indexKey(w, WORKERS)).Val()
+	for i := range names {
+		fields := w.Client.HMGet(ctx, w.Cluster+":workers:"+names[i], "State", "Status", "Healthy", "Heartbeat", "Labels",
+			"ThreadLoad", "MaxThreads").Val()
+		state, _ := fields[0].(string)
+		status, _ := fields[1].(string)
+		healthy, _ := fields[2].(string)
+		heartbeatString, _ := fields[3].(string)
+		labels, _ := fields[4].(string)
+		last, _ := strconv.ParseInt(heartbeatString, 10, 64)
+		if state != ONLINE || status == DISABLED || healthy == "false" || time.Since(time.Unix(0, last)) > timeout {
+			continue
+		}
+		p := peer{Name: names[i], Labels: parseLabels(labels)}
+		if load, ok := fields[5].(string); ok {
+			p.Load, _ = strconv.Atoi(load)
+		}
+		if max, ok := fields[6].(string); ok {
+			p.MaxThreads, _ = strconv.Atoi(max)
+		}
+		peers[names[i]] = p
+	}
+	return peers
+}
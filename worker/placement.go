@@ -0,0 +1,172 @@
+package worker
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRebalanceInterval = time.Minute
+
+// placement is what a task asks of the worker running it.
+type placement struct {
+	Required  string
+	Preferred string
+	Weight    int
+	//Partitioned threads run one instance on every worker that can take them.
+	Partitioned bool
+}
+
+// getPlacement reads a task's label selectors and weight.  Tasks weigh 1
+// unless they say otherwise.
+func getPlacement(w *worker, key string) placement {
+	fields := w.Client.HMGet(ctx, key, "RequiredLabels", "PreferredLabels", "Weight", "Partitions").Val()
+	p := placement{Weight: 1}
+	p.Required, _ = fields[0].(string)
+	p.Preferred, _ = fields[1].(string)
+	if weight, ok := fields[2].(string); ok {
+		if value, err := strconv.Atoi(weight); err == nil && value > 0 {
+			p.Weight = value
+		}
+	}
+	if partitions, ok := fields[3].(string); ok {
+		count, err := strconv.Atoi(partitions)
+		p.Partitioned = err == nil && count > 0
+	}
+	return p
+}
+
+// placeableWorkers returns the live workers a task can run on: the ones with
+// its RequiredLabels, narrowed to the ones with its PreferredLabels if any of
+// those are live.
+func placeableWorkers(p placement, peers map[string]peer) []string {
+	required := make([]string, 0, len(peers))
+	preferred := make([]string, 0, len(peers))
+	for name, other := range peers {
+		if !matchSelector(p.Required, other.Labels) {
+			continue
+		}
+		required = append(required, name)
+		if p.Preferred != "" && matchSelector(p.Preferred, other.Labels) {
+			preferred = append(preferred, name)
+		}
+	}
+	if len(preferred) > 0 {
+		return preferred
+	}
+	return required
+}
+
+// prefersMe reports if this worker satisfies the task's preferred labels.
+func (p placement) prefersMe(w *worker) bool {
+	return p.Preferred != "" && matchSelector(p.Preferred, w.Labels)
+}
+
+// suits reports if a peer could take the task as well as this worker could.
+func (p placement) suits(w *worker, labels map[string]string) bool {
+	if !matchSelector(p.Required, labels) {
+		return false
+	}
+	return !p.prefersMe(w) || matchSelector(p.Preferred, labels)
+}
+
+// canPlace reports if this worker should take a thread or job.  The worker has
+// to satisfy the task's RequiredLabels.  If it doesn't satisfy PreferredLabels
+// it leaves the task to a live worker that does, when there is one.
+func canPlace(w *worker, p placement, peers map[string]peer) bool {
+	if !matchSelector(p.Required, w.Labels) {
+		return false
+	}
+	if p.Preferred == "" || p.prefersMe(w) {
+		return true
+	}
+
+	for name, other := range peers {
+		if name != w.WorkerName && matchSelector(p.Required, other.Labels) && matchSelector(p.Preferred, other.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRoom reports if a task of weight fits under max.  No max means no limit.
+func hasRoom(load int, weight int, max int) bool {
+	return max <= 0 || load+weight <= max
+}
+
+// leastLoaded reports if no live worker that could take the task has less load
+// than this one.  Ties are settled by whoever acquires the thread first.
+func leastLoaded(w *worker, load int, p placement, peers map[string]peer) bool {
+	for name, other := range peers {
+		if name == w.WorkerName || !p.suits(w, other.Labels) || !hasRoom(other.Load, p.Weight, other.MaxThreads) {
+			continue
+		}
+		if other.Load < load {
+			return false
+		}
+	}
+	return true
+}
+
+// localLoad sums the weight of the threads this worker is running.
+func localLoad(w *worker) (load int, count int) {
+	threads := localThreads(w)
+	for i := range threads {
+		if !threads[i].isStopped() {
+			load += threads[i].getWeight()
+			count++
+		}
+	}
+	return
+}
+
+// publishLoad lets the other workers know how busy this one is.
+func publishLoad(w *worker) {
+	load, count := localLoad(w)
+	w.Client.HMSet(ctx, workerKey(w), "ThreadLoad", load, "ThreadCount", count, "MaxThreads", w.MaxThreads)
+}
+
+// rebalanceThreads hands back a thread when this worker is over its capacity
+// or carries noticeably more load than a live worker that could run it.  Only
+// threads light enough not to bounce straight back are moved, one per call.
+func rebalanceThreads(w *worker, peers map[string]peer) {
+	load, _ := localLoad(w)
+	running := make([]*ThreadMeta, 0)
+	threads := localThreads(w)
+	for i := range threads {
+		if !threads[i].isStopped() {
+			running = append(running, threads[i])
+		}
+	}
+	//Heaviest first so the fewest threads move.
+	sort.Slice(running, func(i, j int) bool { return running[i].getWeight() > running[j].getWeight() })
+
+	if !hasRoom(load, 0, w.MaxThreads) {
+		for i := 0; i < len(running) && load > w.MaxThreads; i++ {
+			log.Info("Over capacity, handing back thread ", running[i].Key)
+			load -= running[i].getWeight()
+			running[i].drain(w)
+		}
+		return
+	}
+
+	for i := range running {
+		//A partitioned thread already runs on every worker that can take it.
+		if running[i].placement.Partitioned {
+			continue
+		}
+		weight := running[i].getWeight()
+		for name, other := range peers {
+			if name == w.WorkerName || !running[i].placement.suits(w, other.Labels) || !hasRoom(other.Load, weight, other.MaxThreads) {
+				continue
+			}
+			if weight < load-other.Load {
+				log.Info("Rebalancing thread ", running[i].Key, " towards ", name)
+				running[i].drain(w)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Task kinds, used in task keys and their index sets.
+
+//THREADS threads
+const THREADS = "Threads"
+
+//JOBS jobs
+const JOBS = "Jobs"
+
+//ENDPOINTS endpoints
+const ENDPOINTS = "Endpoints"
+
+// indexScanInterval is how often the keyspace is scanned for tasks written by
+// something that did not register them in the index.
+const indexScanInterval = 5 * time.Minute
+
+// indexScanCount is the COUNT hint given to SCAN.
+const indexScanCount = 1000
+
+func indexKey(w *worker, kind string) string {
+	return w.Cluster + ":Index:" + kind
+}
+
+func taskPrefix(w *worker, kind string) string {
+	return w.Cluster + ":" + kind + ":"
+}
+
+// registerTask adds a task key to the index for its kind.  Anything writing a
+// task to redis should call this so workers can find it.
+func registerTask(w *worker, kind string, key string) {
+	w.Client.SAdd(ctx, indexKey(w, kind), key)
+}
+
+func unregisterTask(w *worker, kind string, key string) {
+	w.Client.SRem(ctx, indexKey(w, kind), key)
+}
+
+// isTaskKey reports if key is a task itself rather than something stored under
+// it, like its versions or error log.
+func isTaskKey(w *worker, kind string, key string) bool {
+	name := strings.TrimPrefix(key, taskPrefix(w, kind))
+	return name != key && name != "" && !strings.Contains(name, ":")
+}
+
+// getTaskKeys returns every registered task of a kind, scanning the keyspace
+// first if it has not been scanned recently.
+func getTaskKeys(w *worker, kind string) []string {
+	w.indexMutex.Lock()
+	if w.indexScans == nil {
+		w.indexScans = make(map[string]time.Time)
+	}
+	scan := time.Since(w.indexScans[kind]) > indexScanInterval
+	if scan {
+		w.indexScans[kind] = time.Now()
+	}
+	w.indexMutex.Unlock()
+
+	if scan {
+		if err := migrateIndex(w, kind); err != nil {
+			log.WithError(err).Error("Error scanning for ", kind)
+		}
+	}
+	return w.Client.SMembers(ctx, indexKey(w, kind)).Val()
+}
+
+// migrateIndex walks the keyspace with SCAN and registers any tasks of kind
+// missing from the index.  Clusters created before the index existed are
+// picked up this way.
+func migrateIndex(w *worker, kind string) error {
+	var cursor uint64
+	for {
+		keys, next, err := w.Client.Scan(ctx, cursor, taskPrefix(w, kind)+"*", indexScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		members := make([]interface{}, 0)
+		for i := range keys {
+			if isTaskKey(w, kind, keys[i]) {
+				members = append(members, keys[i])
+			}
+		}
+		if len(members) > 0 {
+			w.Client.SAdd(ctx, indexKey(w, kind), members...)
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package worker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/robertkrimen/otto"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many due runs a worker picks up per check.
+const scheduledBatch = 100
+
+// scheduledRun is a run of a job queued outside its cron, either triggered by
+// hand or a one-shot job.  Queued runs are kept in <cluster>:Scheduled scored
+// by when they are due in milliseconds.
+type scheduledRun struct {
+	ID     string
+	Key    string
+	Due    int64
+	Params map[string]interface{} `json:",omitempty"`
+}
+
+func scheduledKey(w *worker) string {
+	return w.Cluster + ":Scheduled"
+}
+
+func newRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// queueRun adds a run of a job to the cluster's queue of scheduled runs.
+func queueRun(w *worker, key string, due time.Time, params map[string]interface{}) (string, error) {
+	if taskKind(w, key) != JOBS {
+		return "", errors.New("not a job key: " + key)
+	}
+	run := scheduledRun{ID: newRunID(), Key: key, Due: due.UnixNano(), Params: params}
+	payload, err := json.Marshal(run)
+	if err != nil {
+		return "", err
+	}
+	member := &redis.Z{Score: float64(due.UnixNano() / int64(time.Millisecond)), Member: string(payload)}
+	if err := w.Client.ZAdd(ctx, scheduledKey(w), member).Err(); err != nil {
+		return "", err
+	}
+	publishEvent(w, JOBTRIGGERED, key)
+	return run.ID, nil
+}
+
+// triggerJob runs an existing job as soon as a worker picks it up.
+func triggerJob(w *worker, key string, params map[string]interface{}) (string, error) {
+	if w.Client.Exists(ctx, key).Val() == 0 {
+		return "", errors.New("no such job: " + key)
+	}
+	//A one-shot job already has its run queued and is removed after it.
+	if w.Client.HGet(ctx, key, "OneShot").Val() == "true" {
+		return "", errors.New("one-shot jobs can't be triggered: " + key)
+	}
+	return queueRun(w, key, time.Now(), params)
+}
+
+// createOneShotJobScript saves a one-shot job unless the key is taken.
+// KEYS[1] job, ARGV[1] when it is due, ARGV[2] status, ARGV[3] state.
+var createOneShotJobScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'Status', ARGV[2], 'State', ARGV[3], 'OneShot', 'true', 'RunAt', ARGV[1])
+return 1
+`)
+
+// createOneShotJob saves a job that runs once at due and then removes itself.
+// Existing jobs are never turned into one-shot jobs.
+func createOneShotJob(w *worker, key string, source string, due time.Time, params map[string]interface{}) (string, error) {
+	if taskKind(w, key) != JOBS {
+		return "", errors.New("not a job key: " + key)
+	}
+	created, err := createOneShotJobScript.Run(ctx, w.Client, []string{key}, due.UnixNano(), ENABLED, STOPPED).Int()
+	if err != nil {
+		return "", err
+	}
+	if created != 1 {
+		return "", errors.New("job already exists: " + key)
+	}
+	if _, err := saveSource(w, key, source, w.WorkerName, "One-shot job"); err != nil {
+		return "", err
+	}
+	return queueRun(w, key, due, params)
+}
+
+// checkScheduled starts the queued runs that are due.  Runs are claimed by
+// removing them from the queue so only one worker gets each.  Runs of jobs
+// this worker can't place are left for the workers that can.
+func checkScheduled(w *worker) {
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	due := w.Client.ZRangeByScore(ctx, scheduledKey(w), &redis.ZRangeBy{Min: "-inf", Max: now, Count: scheduledBatch}).Val()
+	if len(due) == 0 {
+		return
+	}
+	jobs := getJobs(w)
+	peers := liveWorkers(w)
+	for i := range due {
+		var run scheduledRun
+		if err := json.Unmarshal([]byte(due[i]), &run); err != nil {
+			log.WithError(err).Error("Dropping unreadable scheduled run")
+			w.Client.ZRem(ctx, scheduledKey(w), due[i])
+			continue
+		}
+		jm := jobs[run.Key]
+		if jm == nil {
+			log.Warn("Dropping scheduled run of missing job ", run.Key)
+			w.Client.ZRem(ctx, scheduledKey(w), due[i])
+			continue
+		}
+		if !canPlace(w, getPlacement(w, run.Key), peers) {
+			continue
+		}
+		//A disabled one-shot job keeps its run until it is enabled again.
+		if fields := w.Client.HMGet(ctx, run.Key, "Status", "OneShot").Val(); fields[0] == DISABLED && fields[1] == "true" {
+			continue
+		}
+		if w.Client.ZRem(ctx, scheduledKey(w), due[i]).Val() != 1 {
+			continue
+		}
+		if !w.track() {
+			//Put it back for the workers that are staying.
+			w.Client.ZAdd(ctx, scheduledKey(w), &redis.Z{Score: float64(run.Due / int64(time.Millisecond)), Member: due[i]})
+			return
+		}
+		go func(run scheduledRun) {
+			defer w.running.Done()
+			ran := jm.start(w, run.ID, time.Unix(0, run.Due), run.Params)
+			if w.Client.HGet(ctx, run.Key, "OneShot").Val() != "true" {
+				return
+			}
+			if ran {
+				removeJob(w, jm)
+				return
+			}
+			//Queue the skipped run again, under a new id since the old one was
+			//claimed, so the job still runs once.
+			if _, err := queueRun(w, run.Key, time.Unix(0, run.Due), run.Params); err != nil {
+				log.WithError(err).Error("Error queueing skipped run of ", run.Key)
+			}
+		}(run)
+	}
+}
+
+// removeJob deletes a job that is done with.  Its run history, errors and logs
+// are kept.
+func removeJob(w *worker, jm *JobMeta) {
+	log.Info("Removing job ", jm.Key)
+	w.Client.Del(ctx, jm.Key, activeKey(jm.Key))
+	forgetJob(w, jm)
+}
+
+// newJobs builds the jobs object for a task's VM.
+func newJobs(w *worker) map[string]interface{} {
+	paramsOf := func(value otto.Value) map[string]interface{} {
+		if !value.IsObject() {
+			return nil
+		}
+		exported, _ := value.Export()
+		params, _ := exported.(map[string]interface{})
+		return params
+	}
+	result := func(call otto.FunctionCall, id string, err error) otto.Value {
+		if err != nil {
+			panic(call.Otto.MakeCustomError("JobError", err.Error()))
+		}
+		value, _ := call.Otto.ToValue(id)
+		return value
+	}
+
+	return map[string]interface{}{
+		//Trigger(key, params) runs a job now, returns the run id
+		"Trigger": func(call otto.FunctionCall) otto.Value {
+			id, err := triggerJob(w, call.Argument(0).String(), paramsOf(call.Argument(1)))
+			return result(call, id, err)
+		},
+		//RunAt(key, source, time, params) creates a job that runs once at a
+		//Date or time in milliseconds, returns the run id
+		"RunAt": func(call otto.FunctionCall) otto.Value {
+			var due time.Time
+			exported, _ := call.Argument(2).Export()
+			switch at := exported.(type) {
+			case time.Time:
+				due = at
+			default:
+				ms, err := call.Argument(2).ToInteger()
+				if err != nil {
+					panic(call.Otto.MakeTypeError("time must be a Date or milliseconds"))
+				}
+				due = time.Unix(0, ms*int64(time.Millisecond))
+			}
+			id, err := createOneShotJob(w, call.Argument(0).String(), call.Argument(1).String(), due, paramsOf(call.Argument(3)))
+			return result(call, id, err)
+		},
+		//RunAfter(key, source, delay, params) creates a job that runs once after
+		//a delay like "30s" or in seconds, returns the run id
+		"RunAfter": func(call otto.FunctionCall) otto.Value {
+			delay := parseDuration(call.Argument(2).String())
+			due := time.Now().Add(delay)
+			id, err := createOneShotJob(w, call.Argument(0).String(), call.Argument(1).String(), due, paramsOf(call.Argument(3)))
+			return result(call, id, err)
+		},
+	}
+}
@@ -0,0 +1,311 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/robertkrimen/otto"
+	log "github.com/sirupsen/logrus"
+)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// scriptMetric describes a metric a script created.
+type scriptMetric struct {
+	Type    string
+	Help    string
+	Buckets []float64 `json:",omitempty"`
+}
+
+// scriptMetricsKey holds the definitions of a task's metrics by name.
+func scriptMetricsKey(key string) string {
+	return key + ":Metrics"
+}
+
+// clusterMetricsKey holds the type of every script metric name in the cluster.
+// Tasks are exported side by side so a name can only have one type.
+func clusterMetricsKey(w *worker) string {
+	return w.Cluster + ":Metrics"
+}
+
+// scriptMetricTasksKey lists the tasks that have script metrics.
+func scriptMetricTasksKey(w *worker) string {
+	return w.Cluster + ":Metrics:Tasks"
+}
+
+// scriptMetricValuesKey holds the samples of a task's metrics, keyed by the
+// sample name and label set they are exported with.
+func scriptMetricValuesKey(key string) string {
+	return key + ":Metrics:Values"
+}
+
+// newScriptMetrics builds the metrics object for a task's VM.  Metrics are kept
+// in redis under the task so they carry on counting when the task moves to
+// another worker or runs on several.  The leader exports them.
+func newScriptMetrics(w *worker, key string) map[string]interface{} {
+	define := func(call otto.FunctionCall, kind string) scriptMetric {
+		name := call.Argument(0).String()
+		//hats_ is left for the worker's own metrics.
+		if !metricNamePattern.MatchString(name) || strings.HasPrefix(name, "hats_") {
+			panic(call.Otto.MakeTypeError("invalid metric name " + name))
+		}
+		metric := scriptMetric{Type: kind, Help: call.Argument(1).String()}
+		if call.Argument(1).IsUndefined() {
+			metric.Help = name
+		}
+		if kind == histogramMetric {
+			metric.Buckets = durationBuckets
+			if exported, err := call.Argument(2).Export(); err == nil && call.Argument(2).IsObject() {
+				if buckets := toBuckets(exported); len(buckets) > 0 {
+					metric.Buckets = buckets
+				}
+			}
+		}
+
+		w.Client.HSetNX(ctx, clusterMetricsKey(w), name, kind)
+		if registered := w.Client.HGet(ctx, clusterMetricsKey(w), name).Val(); registered != kind {
+			panic(call.Otto.MakeTypeError("metric " + name + " is already a " + registered + " in another task"))
+		}
+		definition, _ := json.Marshal(metric)
+		w.Client.HSetNX(ctx, scriptMetricsKey(key), name, string(definition))
+		var existing scriptMetric
+		json.Unmarshal([]byte(w.Client.HGet(ctx, scriptMetricsKey(key), name).Val()), &existing)
+		if existing.Type != kind {
+			panic(call.Otto.MakeTypeError("metric " + name + " is already a " + existing.Type))
+		}
+		return existing
+	}
+
+	labelsOf := func(call otto.FunctionCall, value otto.Value) string {
+		labels := []string{"task", key}
+		if value.IsObject() {
+			exported, _ := value.Export()
+			object, _ := exported.(map[string]interface{})
+			names := make([]string, 0, len(object))
+			for name := range object {
+				if !labelNamePattern.MatchString(name) || name == "task" || name == "le" {
+					panic(call.Otto.MakeTypeError("invalid label name " + name))
+				}
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for i := range names {
+				labels = append(labels, names[i], fmt.Sprint(object[names[i]]))
+			}
+		}
+		return formatLabels(labels...)
+	}
+
+	number := func(call otto.FunctionCall, value otto.Value) float64 {
+		n, err := value.ToFloat()
+		if err != nil || math.IsNaN(n) {
+			panic(call.Otto.MakeTypeError("metric value must be a number"))
+		}
+		return n
+	}
+
+	return map[string]interface{}{
+		//counter(name, help) has inc(labels) and add(value, labels)
+		"counter": func(call otto.FunctionCall) otto.Value {
+			name := call.Argument(0).String()
+			define(call, counterMetric)
+			add := func(call otto.FunctionCall, value float64, labels otto.Value) {
+				if value < 0 {
+					panic(call.Otto.MakeRangeError("counters can only go up"))
+				}
+				series := name + "{" + labelsOf(call, labels) + "}"
+				updateScriptMetric(w, key, func(pipe redis.Pipeliner) {
+					pipe.HIncrByFloat(ctx, scriptMetricValuesKey(key), series, value)
+				})
+			}
+			value, _ := call.Otto.ToValue(map[string]interface{}{
+				"inc": func(call otto.FunctionCall) otto.Value {
+					add(call, 1, call.Argument(0))
+					return otto.UndefinedValue()
+				},
+				"add": func(call otto.FunctionCall) otto.Value {
+					add(call, number(call, call.Argument(0)), call.Argument(1))
+					return otto.UndefinedValue()
+				},
+			})
+			return value
+		},
+		//gauge(name, help) has set(value, labels), inc(labels) and dec(labels)
+		"gauge": func(call otto.FunctionCall) otto.Value {
+			name := call.Argument(0).String()
+			define(call, gaugeMetric)
+			add := func(call otto.FunctionCall, value float64, labels otto.Value) {
+				series := name + "{" + labelsOf(call, labels) + "}"
+				updateScriptMetric(w, key, func(pipe redis.Pipeliner) {
+					pipe.HIncrByFloat(ctx, scriptMetricValuesKey(key), series, value)
+				})
+			}
+			value, _ := call.Otto.ToValue(map[string]interface{}{
+				"set": func(call otto.FunctionCall) otto.Value {
+					value := number(call, call.Argument(0))
+					series := name + "{" + labelsOf(call, call.Argument(1)) + "}"
+					updateScriptMetric(w, key, func(pipe redis.Pipeliner) {
+						pipe.HSet(ctx, scriptMetricValuesKey(key), series, value)
+					})
+					return otto.UndefinedValue()
+				},
+				"inc": func(call otto.FunctionCall) otto.Value {
+					add(call, 1, call.Argument(0))
+					return otto.UndefinedValue()
+				},
+				"dec": func(call otto.FunctionCall) otto.Value {
+					add(call, -1, call.Argument(0))
+					return otto.UndefinedValue()
+				},
+			})
+			return value
+		},
+		//histogram(name, help, buckets) has observe(value, labels)
+		"histogram": func(call otto.FunctionCall) otto.Value {
+			name := call.Argument(0).String()
+			metric := define(call, histogramMetric)
+			value, _ := call.Otto.ToValue(map[string]interface{}{
+				"observe": func(call otto.FunctionCall) otto.Value {
+					value := number(call, call.Argument(0))
+					labels := labelsOf(call, call.Argument(1))
+					updateScriptMetric(w, key, func(pipe redis.Pipeliner) {
+						values := scriptMetricValuesKey(key)
+						for i := range metric.Buckets {
+							//Every bucket is written so empty ones are exported as 0.
+							count := int64(0)
+							if value <= metric.Buckets[i] {
+								count = 1
+							}
+							le := strconv.FormatFloat(metric.Buckets[i], 'g', -1, 64)
+							pipe.HIncrBy(ctx, values, name+"_bucket{"+labels+`,le="`+le+`"}`, count)
+						}
+						pipe.HIncrBy(ctx, values, name+"_bucket{"+labels+`,le="+Inf"}`, 1)
+						pipe.HIncrByFloat(ctx, values, name+"_sum{"+labels+"}", value)
+						pipe.HIncrBy(ctx, values, name+"_count{"+labels+"}", 1)
+					})
+					return otto.UndefinedValue()
+				},
+			})
+			return value
+		},
+	}
+}
+
+func toBuckets(exported interface{}) []float64 {
+	buckets := make([]float64, 0)
+	switch values := exported.(type) {
+	case []interface{}:
+		for i := range values {
+			if bucket, err := strconv.ParseFloat(fmt.Sprint(values[i]), 64); err == nil {
+				buckets = append(buckets, bucket)
+			}
+		}
+	case []int64:
+		for i := range values {
+			buckets = append(buckets, float64(values[i]))
+		}
+	case []float64:
+		buckets = append(buckets, values...)
+	}
+	sort.Float64s(buckets)
+	return buckets
+}
+
+// updateScriptMetric applies an update to a task's metrics.
+func updateScriptMetric(w *worker, key string, update func(pipe redis.Pipeliner)) {
+	_, err := w.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		update(pipe)
+		pipe.SAdd(ctx, scriptMetricTasksKey(w), key)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Error updating metrics of ", key)
+	}
+}
+
+// writeScriptMetrics exports the script metrics of every task.  Only the leader
+// exports them, so each series comes from one worker however many run the task.
+func writeScriptMetrics(w *worker, out io.Writer) {
+	if !w.isLeader() {
+		return
+	}
+	tasks := w.Client.SMembers(ctx, scriptMetricTasksKey(w)).Val()
+	sort.Strings(tasks)
+	definitions := make(map[string]scriptMetric)
+	samples := make(map[string][]string)
+	for i := range tasks {
+		own := make(map[string]scriptMetric)
+		for name, definition := range w.Client.HGetAll(ctx, scriptMetricsKey(tasks[i])).Val() {
+			var metric scriptMetric
+			if json.Unmarshal([]byte(definition), &metric) == nil {
+				own[name] = metric
+				if _, ok := definitions[name]; !ok {
+					definitions[name] = metric
+				}
+			}
+		}
+		for series, value := range w.Client.HGetAll(ctx, scriptMetricValuesKey(tasks[i])).Val() {
+			name := strings.SplitN(series, "{", 2)[0]
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(name, suffix); own[base].Type == histogramMetric {
+					name = base
+				}
+			}
+			//Left out if another task already exports the name as another type.
+			if own[name].Type != definitions[name].Type {
+				continue
+			}
+			samples[name] = append(samples[name], series+" "+value)
+		}
+	}
+
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range names {
+		if len(samples[names[i]]) == 0 {
+			continue
+		}
+		metric := definitions[names[i]]
+		writeHeader(out, names[i], metric.Type, metric.Help)
+		lines := samples[names[i]]
+		sort.Slice(lines, func(a, b int) bool { return sampleLess(lines[a], lines[b]) })
+		for j := range lines {
+			fmt.Fprintln(out, lines[j])
+		}
+	}
+}
+
+// sampleLess orders samples by series with histogram buckets in order of le.
+func sampleLess(a string, b string) bool {
+	aSeries, aLe := splitLe(a)
+	bSeries, bLe := splitLe(b)
+	if aSeries != bSeries {
+		return aSeries < bSeries
+	}
+	return aLe < bLe
+}
+
+func splitLe(sample string) (string, float64) {
+	series := strings.SplitN(sample, " ", 2)[0]
+	index := strings.Index(series, `,le="`)
+	if index < 0 {
+		return series, 0
+	}
+	le := strings.TrimSuffix(series[index+len(`,le="`):], `"}`)
+	if le == "+Inf" {
+		return series[:index], math.Inf(1)
+	}
+	bound, _ := strconv.ParseFloat(le, 64)
+	return series[:index], bound
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+)
+
+func settingsKey(w *worker) string {
+	return w.Cluster + ":Settings"
+}
+
+// getTaskSetting returns a field from the task hash, falling back to the
+// cluster wide default in <cluster>:Settings.
+func getTaskSetting(w *worker, key string, field string) string {
+	value := w.Client.HGet(ctx, key, field).Val()
+	if value == "" {
+		value = w.Client.HGet(ctx, settingsKey(w), field).Val()
+	}
+	return value
+}
+
+// getTaskDuration reads a setting as a duration.  Plain numbers are seconds.
+func getTaskDuration(w *worker, key string, field string) time.Duration {
+	return parseDuration(getTaskSetting(w, key, field))
+}
+
+func parseDuration(value string) time.Duration {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	duration, _ := time.ParseDuration(value)
+	return duration
+}
@@ -1,26 +1,286 @@
 package worker
 
 import (
+	"math/rand"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/robertkrimen/otto"
 	log "github.com/sirupsen/logrus"
 )
 
+// acquireThreadScript takes ownership of a thread in one step.  A thread can be
+// taken when it is stopped, when its lease has expired, when a crashed thread
+// is due to restart or when a thread disabled by a crash was enabled again.
+// Taking it bumps the fencing token so the previous owner knows it has been
+// replaced.
+// KEYS[1] thread key, KEYS[2] key of the thread's definition, which is the same
+// key unless the thread is a replica, ARGV[1] worker name, ARGV[2] now in
+// nanoseconds, ARGV[3] default lease in seconds.
+var acquireThreadScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return -1
+end
+local config = redis.call('HMGET', KEYS[2], 'Status', 'DeadSeconds')
+if config[1] == 'disabled' then
+	return 0
+end
+local fields = redis.call('HMGET', KEYS[1], 'State', 'LeaseExpires', 'Heartbeat', 'NextAttempt')
+local now = tonumber(ARGV[2])
+local lease = tonumber(config[2])
+if lease == nil or lease == 0 then
+	lease = tonumber(ARGV[3])
+end
+-- Replicas have no hash of their own until they are first taken.
+local available = fields[1] == 'stopped' or (not fields[1] and KEYS[1] ~= KEYS[2])
+if fields[1] == 'crashed' or fields[1] == 'crashloop' then
+	-- Crashed threads wait for the restart their policy scheduled.  One with no
+	-- restart scheduled was disabled and has been enabled again since, so it
+	-- starts over.
+	local nextAttempt = tonumber(fields[4])
+	if nextAttempt == nil or nextAttempt == 0 then
+		available = true
+		redis.call('HSET', KEYS[1], 'RestartCount', 0)
+	else
+		available = nextAttempt <= now
+	end
+elseif not available then
+	local expires = tonumber(fields[2])
+	if expires == nil then
+		-- Threads written before leases existed only carry a heartbeat.
+		local heartbeat = tonumber(fields[3])
+		if heartbeat ~= nil and heartbeat ~= 0 then
+			expires = heartbeat + lease * 1e9
+		end
+	end
+	available = expires ~= nil and expires ~= 0 and expires < now
+end
+if not available then
+	return 0
+end
+local token = redis.call('HINCRBY', KEYS[1], 'Token', 1)
+redis.call('HMSET', KEYS[1], 'State', 'running', 'Owner', ARGV[1], 'Heartbeat', ARGV[2],
+	'LeaseExpires', string.format('%.0f', now + lease * 1e9))
+return token
+`)
+
+// renewThreadScript extends the lease if the caller still holds the token.
+// KEYS[1] thread key, KEYS[2] definition key, ARGV[1] token, ARGV[2] worker
+// name, ARGV[3] now in nanoseconds, ARGV[4] default lease in seconds.
+var renewThreadScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'Token', 'Owner')
+if fields[1] ~= ARGV[1] or fields[2] ~= ARGV[2] then
+	return 0
+end
+local lease = tonumber(redis.call('HGET', KEYS[2], 'DeadSeconds'))
+if lease == nil or lease == 0 then
+	lease = tonumber(ARGV[4])
+end
+redis.call('HMSET', KEYS[1], 'Heartbeat', ARGV[3],
+	'LeaseExpires', string.format('%.0f', tonumber(ARGV[3]) + lease * 1e9))
+return 1
+`)
+
+// releaseThreadScript sets the state of a thread if the caller still holds the
+// token.  KEYS[1] thread key, ARGV[1] token, ARGV[2] worker name, ARGV[3] state,
+// ARGV[4..] more fields and values to set along with it.
+var releaseThreadScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'Token', 'Owner')
+if fields[1] ~= ARGV[1] or fields[2] ~= ARGV[2] then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'State', ARGV[3], 'LeaseExpires', 0)
+for i = 4, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
 //ThreadMeta struct that represents a thread
 type ThreadMeta struct {
 	Key     string
 	Stopped bool
-	vm      *otto.Otto
+	//Definition is the key holding the source and settings.  Replicas of a
+	//thread share it, the first instance is the definition itself.
+	Definition string
+	Instance   int
+	replicas   int
+	vm         *otto.Otto
+	//Guards Stopped, vm, reloadRequested and active, which the lease keeper,
+	//cluster events and the worker's checks touch while the thread runs.
+	mutex sync.Mutex
+	//Set from when the thread is taken until its run has finished cleaning up.
+	active  bool
+	token   int64
+	version string
+	//When the restart count is cleared if the thread keeps running.
+	forgiveAt      time.Time
+	mainTimeout    time.Duration
+	cleanupTimeout time.Duration
+	//Set when the source changed and the thread should reload it.
+	reloadRequested bool
+	placement       placement
+	//Partitions this instance holds, guarded since keepLease renews them.
+	partitions      []int
+	partitionsMutex sync.Mutex
+	//Whether the script was last told the worker is leader.
+	leader bool
 }
 
 func (tm *ThreadMeta) getVM() *otto.Otto {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
 	return tm.vm
 }
 
+func (tm *ThreadMeta) setVM(vm *otto.Otto) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.vm = vm
+}
+
+func (tm *ThreadMeta) isStopped() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.Stopped
+}
+
+func (tm *ThreadMeta) setStopped(stopped bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.Stopped = stopped
+}
+
+// halt marks the thread stopped and interrupts whatever its script is running.
+// Returns false if it was already stopped.
+func (tm *ThreadMeta) halt() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.Stopped {
+		return false
+	}
+	tm.Stopped = true
+	interruptVM(tm.vm)
+	return true
+}
+
+// begin marks the thread as running here.  Returns false if its last run is
+// still going, a stopped thread isn't taken again until cleanup() is done.
+func (tm *ThreadMeta) begin() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.active {
+		return false
+	}
+	tm.active = true
+	return true
+}
+
+// end marks the thread's run as finished.
+func (tm *ThreadMeta) end() {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.active = false
+}
+
+// requestReload asks a running thread to pick up new source before its next
+// main().
+func (tm *ThreadMeta) requestReload() {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if !tm.Stopped {
+		tm.reloadRequested = true
+	}
+}
+
+// takeReloadRequest reports whether a reload was asked for and clears it.
+func (tm *ThreadMeta) takeReloadRequest() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	requested := tm.reloadRequested
+	tm.reloadRequested = false
+	return requested
+}
+
+// getKey returns the definition so every replica shares its settings, logs and
+// metrics.
+func (tm *ThreadMeta) getKey() string {
+	return tm.definition()
+}
+
+func (tm *ThreadMeta) definition() string {
+	if tm.Definition == "" {
+		return tm.Key
+	}
+	return tm.Definition
+}
+
+// getWeight returns how much of a worker's capacity the thread was taken with.
+func (tm *ThreadMeta) getWeight() int {
+	if tm.placement.Weight <= 0 {
+		return 1
+	}
+	return tm.placement.Weight
+}
+
+// instanceKey returns where the ownership of a replica of a thread is kept.
+// The first instance is the thread itself.
+func instanceKey(key string, instance int) string {
+	if instance == 0 {
+		return key
+	}
+	return key + ":Instances:" + strconv.Itoa(instance)
+}
+
+func parseReplicas(value interface{}) int {
+	replicas := 1
+	if s, ok := value.(string); ok {
+		if n, err := strconv.Atoi(s); err == nil && n > 1 {
+			replicas = n
+		}
+	}
+	return replicas
+}
+
+// getReplicas returns how many instances of a thread should run.  A
+// partitioned thread runs an instance on every live worker that can take it.
+func getReplicas(w *worker, key string) int {
+	p := getPlacement(w, key)
+	if p.Partitioned {
+		if replicas := len(placeableWorkers(p, liveWorkers(w))); replicas > 1 {
+			return replicas
+		}
+		return 1
+	}
+	return parseReplicas(w.Client.HMGet(ctx, key, "Replicas").Val()[0])
+}
+
+// threadInstanceKeys returns the keys of every instance of a thread.
+func threadInstanceKeys(w *worker, key string) []string {
+	replicas := getReplicas(w, key)
+	keys := make([]string, replicas)
+	for i := range keys {
+		keys[i] = instanceKey(key, i)
+	}
+	return keys
+}
+
+// setReplicas lets a running script see the thread was scaled.
+func (tm *ThreadMeta) setReplicas(replicas int) {
+	tm.replicas = replicas
+	vm := tm.getVM()
+	if vm == nil {
+		return
+	}
+	if thread, err := vm.Get("thread"); err == nil && thread.IsObject() {
+		thread.Object().Set("Replicas", replicas)
+	}
+}
+
 func (tm *ThreadMeta) getStatus(w *worker) (status string) {
-	status = w.Client.HGet(ctx, tm.Key, "Status").Val()
+	status = w.Client.HGet(ctx, tm.definition(), "Status").Val()
 	return
 }
 
@@ -30,10 +290,15 @@ func (tm *ThreadMeta) getState(w *worker) (state string) {
 }
 
 func (tm *ThreadMeta) getSource(w *worker) (source string) {
-	source = w.Client.HGet(ctx, tm.Key, "Source").Val()
+	source = w.Client.HGet(ctx, tm.definition(), "Source").Val()
 	return
 }
 
+// getSourceVersion returns the active source with its version.
+func (tm *ThreadMeta) getSourceVersion(w *worker) (source string, version string) {
+	return getActiveSource(w, tm.definition())
+}
+
 func (tm *ThreadMeta) getHeartBeat(w *worker) (hb int, err error) {
 	hbString := w.Client.HGet(ctx, tm.Key, "Heartbeat").Val()
 	hb, err = strconv.Atoi(hbString)
@@ -48,131 +313,411 @@ func (tm *ThreadMeta) getOwner(w *worker) (owner string) {
 }
 
 func (tm *ThreadMeta) getDeadSeconds(w *worker) (deadSeconds int, err error) {
-	deadSeconds, err = w.Client.HGet(ctx, tm.Key, "DeadSeconds").Int()
+	deadSeconds, err = w.Client.HGet(ctx, tm.definition(), "DeadSeconds").Int()
 	return
 }
 
-func (tm *ThreadMeta) take(w *worker) {
-	log.Info("Taking thread ", tm.Key)
-	tm.Stopped = false
-	w.Client.HSet(ctx, tm.Key, "State", RUNNING)
-	w.Client.HSet(ctx, tm.Key, "Heartbeat", time.Now().UnixNano())
-	w.Client.HSet(ctx, tm.Key, "Owner", w.WorkerName)
-	go tm.run(w)
+// getLease returns how long ownership lasts without being renewed.
+func (tm *ThreadMeta) getLease(w *worker) time.Duration {
+	deadSeconds, err := tm.getDeadSeconds(w)
+	if err != nil || deadSeconds == 0 {
+		deadSeconds = w.SecondsTillDead
+	}
+	return time.Duration(deadSeconds) * time.Second
 }
 
-func (tm *ThreadMeta) stop(w *worker) {
-	if tm.getOwner(w) == w.WorkerName && !tm.Stopped {
-		log.Info("Stopping thread ", tm.Key)
-		tm.Stopped = true
-		w.Client.HSet(ctx, tm.Key, "State", STOPPED)
-		if tm.vm != nil {
-			tm.vm.Interrupt <- func() {
-				log.Error("Stopping threads")
+// acquire atomically takes ownership of the thread and returns the new fencing
+// token, 0 if the thread is not available or -1 if it no longer exists.
+func (tm *ThreadMeta) acquire(w *worker) (token int64, err error) {
+	token, err = acquireThreadScript.Run(ctx, w.Client, []string{tm.Key, tm.definition()}, w.WorkerName, time.Now().UnixNano(), w.SecondsTillDead).Int64()
+	return
+}
+
+// renew extends the lease on the thread.  Returns false if another worker has
+// taken the thread since token was issued.
+func (tm *ThreadMeta) renew(w *worker, token int64) bool {
+	renewed, err := renewThreadScript.Run(ctx, w.Client, []string{tm.Key, tm.definition()}, token, w.WorkerName, time.Now().UnixNano(), w.SecondsTillDead).Int()
+	if err != nil {
+		log.WithError(err).Error("Error renewing lease on thread ", tm.Key)
+		return false
+	}
+	return renewed == 1
+}
+
+// release sets the state of the thread, and any other fields given as pairs,
+// as long as token is still current.
+func (tm *ThreadMeta) release(w *worker, token int64, state string, fields ...interface{}) bool {
+	args := append([]interface{}{token, w.WorkerName, state}, fields...)
+	released, err := releaseThreadScript.Run(ctx, w.Client, []string{tm.Key}, args...).Int()
+	if err != nil {
+		log.WithError(err).Error("Error releasing thread ", tm.Key)
+		return false
+	}
+	if released == 1 && state == STOPPED {
+		publishEvent(w, THREADSTOPPED, tm.Key)
+	}
+	return released == 1
+}
+
+// keepLease renews the lease while the thread runs so a long main() does not
+// look dead.  If ownership is lost the VM is interrupted right away.
+func (tm *ThreadMeta) keepLease(w *worker, token int64, done chan struct{}) {
+	ticker := time.NewTicker(tm.getLease(w) / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !tm.renew(w, token) {
+				log.Warn("Lost ownership of thread ", tm.Key)
+				tm.halt()
 				return
 			}
+			tm.renewPartitions(w)
 		}
 	}
 }
 
+func (tm *ThreadMeta) take(w *worker) bool {
+	if !w.track() {
+		return false
+	}
+	if !tm.begin() {
+		w.running.Done()
+		return false
+	}
+	token, err := tm.acquire(w)
+	if err != nil {
+		tm.end()
+		w.running.Done()
+		log.WithError(err).Error("Error taking thread ", tm.Key)
+		return false
+	}
+	if token < 0 {
+		tm.end()
+		w.running.Done()
+		if tm.Instance > 0 {
+			w.Client.Del(ctx, tm.Key)
+		}
+		forgetThread(w, tm.Key)
+		return false
+	}
+	if token == 0 {
+		tm.end()
+		w.running.Done()
+		return false
+	}
+	log.Info("Taking thread ", tm.Key)
+	tm.setStopped(false)
+	tm.token = token
+	tm.placement = getPlacement(w, tm.definition())
+	go func() {
+		defer w.running.Done()
+		defer tm.end()
+		tm.run(w, token)
+	}()
+	return true
+}
+
+func (tm *ThreadMeta) stop(w *worker) {
+	if tm.getOwner(w) == w.WorkerName && tm.halt() {
+		log.Info("Stopping thread ", tm.Key)
+		tm.release(w, tm.token, STOPPED)
+	}
+}
+
+// drain asks a running thread to finish.  Its run loop runs cleanup() and then
+// hands the thread back.
+func (tm *ThreadMeta) drain(w *worker) {
+	if tm.halt() {
+		log.Info("Draining thread ", tm.Key)
+	}
+}
+
+// forceStop hands back a thread that was asked to stop but didn't finish in
+// time, and interrupts whatever it is still running.
+func (tm *ThreadMeta) forceStop(w *worker) {
+	tm.setStopped(true)
+	interruptVM(tm.getVM())
+	if tm.getOwner(w) == w.WorkerName && tm.getState(w) == RUNNING {
+		log.Warn("Handing back thread ", tm.Key, " that did not finish")
+		tm.release(w, tm.token, STOPPED)
+	}
+}
+
 func (tm *ThreadMeta) disable(w *worker) {
-	if tm.getOwner(w) == w.WorkerName && !tm.Stopped {
+	if tm.getOwner(w) == w.WorkerName && tm.halt() {
 		log.Info("Disabling thread ", tm.Key)
-		tm.Stopped = true
-		w.Client.HSet(ctx, tm.Key, "State", STOPPED)
-		w.Client.HSet(ctx, tm.Key, "Status", DISABLED)
-		if tm.vm != nil {
-			tm.vm.Interrupt <- func() {
-				log.Error("Disabled thread")
-				return
-			}
-		}
+		tm.release(w, tm.token, STOPPED)
+		w.Client.HSet(ctx, tm.definition(), "Status", DISABLED)
+		publishEvent(w, THREADDISABLED, tm.definition())
 	}
 }
 
-func (tm *ThreadMeta) run(w *worker) {
-	log.Info("Starting Thread ", tm.Key)
+// crash marks the thread as crashed if we still own it.  It then rolls back to
+// the version it ran before or schedules a restart if it can, otherwise the
+// thread is disabled.  The thread keeps its lease until that is decided and is
+// handed back in one step, so a worker dying part way leaves it to expire.
+func (tm *ThreadMeta) crash(w *worker, token int64, phase string, err error) {
+	if !tm.renew(w, token) {
+		return
+	}
+	w.metrics.add("hats_task_crashes_total", "Times a task failed.", 1, "task", tm.Key, "phase", phase)
+	recordError(w, tm.definition(), phase, tm.version, err)
+	if autoRollback(w, tm.definition()) {
+		//Hand the thread back so the previous version starts up.
+		tm.release(w, token, STOPPED, "RestartCount", 0)
+		return
+	}
+	tm.scheduleRestart(w, token)
+}
 
-	tm.vm = otto.New()
-	tm.vm.Interrupt = make(chan func(), 1)
-	applyLibrary(w, tm)
-	source := tm.getSource(w)
+// scheduleRestart applies the thread's RestartPolicy after a crash.
+func (tm *ThreadMeta) scheduleRestart(w *worker, token int64) {
+	policy := getTaskSetting(w, tm.definition(), "RestartPolicy")
+	if policy != RESTARTONFAILURE && policy != RESTARTALWAYS {
+		w.Client.HSet(ctx, tm.definition(), "Status", DISABLED)
+		//Nothing scheduled, so the thread starts over once it is enabled again.
+		tm.release(w, token, CRASHED, "NextAttempt", 0)
+		return
+	}
+
+	restarts, _ := w.Client.HGet(ctx, tm.Key, "RestartCount").Int()
+	maxRetries, err := strconv.Atoi(getTaskSetting(w, tm.definition(), "MaxRetries"))
+	if err != nil {
+		maxRetries = defaultMaxRetries
+	}
+	if policy == RESTARTONFAILURE && restarts >= maxRetries {
+		log.Error("Thread ", tm.Key, " crashed ", restarts+1, " times, giving up")
+		w.Client.HSet(ctx, tm.definition(), "Status", DISABLED)
+		tm.release(w, token, CRASHLOOP, "NextAttempt", 0)
+		return
+	}
+
+	delay := restartBackoff(restarts, tm.getBackoffBase(w), tm.getBackoffMax(w))
+	log.Warn("Restarting thread ", tm.Key, " in ", delay)
+	tm.release(w, token, CRASHED, "RestartCount", restarts+1, "NextAttempt", time.Now().Add(delay).UnixNano())
+}
+
+func (tm *ThreadMeta) getBackoffBase(w *worker) time.Duration {
+	base := getTaskDuration(w, tm.definition(), "BackoffBase")
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	return base
+}
+
+func (tm *ThreadMeta) getBackoffMax(w *worker) time.Duration {
+	max := getTaskDuration(w, tm.definition(), "BackoffMax")
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	return max
+}
+
+// restartBackoff doubles the delay for every restart up to max, then picks a
+// random point in the upper half so crashed threads don't restart in lockstep.
+func restartBackoff(restarts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < restarts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// forgiveRestarts clears the restart count once the thread has run longer than
+// its longest backoff without crashing.
+func (tm *ThreadMeta) forgiveRestarts(w *worker) {
+	if !tm.forgiveAt.IsZero() && time.Now().After(tm.forgiveAt) {
+		tm.forgiveAt = time.Time{}
+		w.Client.HSet(ctx, tm.Key, "RestartCount", 0)
+	}
+}
+
+// load builds a new VM for the thread, runs the top level of the script and
+// then init().  Returns false if the thread crashed or has nothing to run.
+func (tm *ThreadMeta) load(w *worker, token int64) bool {
+	source, version := tm.getSourceVersion(w)
 	if source == "" {
 		log.Error("Source empty for thread ", tm.Key)
-		return
+		return false
 	}
+
+	tm.replicas = getReplicas(w, tm.definition())
+	tm.leader = false
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	tm.setVM(vm)
+	applyLibrary(w, tm)
+	tm.version = version
+	tm.mainTimeout = getTaskDuration(w, tm.definition(), "MainTimeout")
+	tm.cleanupTimeout = getTaskDuration(w, tm.definition(), "CleanupTimeout")
+
 	//Get whole script in memory.
-	_, err := tm.vm.Run(source)
+	_, err := runScript(vm, source, getTaskDuration(w, tm.definition(), "LoadTimeout"))
 	if err != nil {
-		w.Client.HSet(ctx, tm.Key, "State", CRASHED)
-		w.Client.HSet(ctx, tm.Key, "Status", DISABLED)
-		w.Client.HSet(ctx, tm.Key, "Error", err.Error())
-		w.Client.HSet(ctx, tm.Key, "ErrorTime", time.Now())
-		log.WithError(err).Error("Syntax error in script.")
+		if err != errInterrupted {
+			tm.crash(w, token, PHASELOAD, err)
+			log.WithError(err).Error("Syntax error in script.")
+		} else {
+			tm.release(w, token, STOPPED)
+		}
+		return false
+	}
+
+	// Check to make sure since should stop could of changed.
+	if !tm.isStopped() {
+		_, err := runScript(vm, "if (typeof init === 'function') {init()}", getTaskDuration(w, tm.definition(), "InitTimeout"))
+		if err != nil && err != errInterrupted {
+			tm.crash(w, token, PHASEINIT, err)
+			log.WithError(err).Error("Error running init() in script " + tm.Key)
+			return false
+		}
+	}
+
+	w.Client.HSet(ctx, tm.Key, "DeployedVersion", version)
+	tm.forgiveAt = time.Now().Add(tm.getBackoffMax(w))
+	return true
+}
+
+// cleanup runs cleanup() in the current VM if the script has one.
+func (tm *ThreadMeta) cleanup(w *worker) {
+	vm := tm.getVM()
+	drainInterrupts(vm)
+	_, err := runScript(vm, "if (typeof cleanup === 'function') {cleanup()}", tm.cleanupTimeout)
+	if err != nil && err != errInterrupted {
+		recordError(w, tm.definition(), PHASECLEANUP, tm.version, err)
+		log.WithError(err).Error("Error cleaning up thread: ", tm.Key)
+	}
+}
+
+// reload swaps the running script for the latest source without giving up
+// ownership of the thread.
+func (tm *ThreadMeta) reload(w *worker, token int64) bool {
+	_, version := tm.getSourceVersion(w)
+	if version == tm.version {
+		return true
+	}
+
+	log.Info("Reloading thread ", tm.Key, " to version ", version)
+	tm.cleanup(w)
+	return tm.load(w, token)
+}
+
+// runHook calls a function of the script if it has one.  Returns false if the
+// function failed and crashed the thread.
+func (tm *ThreadMeta) runHook(w *worker, token int64, phase string, name string, args string) bool {
+	_, err := runScript(tm.getVM(), "if (typeof "+name+" === 'function') {"+name+"("+args+")}", tm.mainTimeout)
+	if err != nil && err != errInterrupted {
+		tm.crash(w, token, phase, err)
+		log.WithError(err).Error("Error running " + name + "() in script " + tm.Key)
+		return false
+	}
+	return true
+}
+
+func (tm *ThreadMeta) run(w *worker, token int64) {
+	log.Info("Starting Thread ", tm.Key)
+	defer tm.setStopped(true)
+
+	done := make(chan struct{})
+	defer close(done)
+	go tm.keepLease(w, token, done)
+	defer tm.releaseAllPartitions(w)
+
+	hang, hangErr := w.Client.HGet(ctx, tm.definition(), "Hang").Int()
+	if hangErr != nil {
+		log.WithError(hangErr).Error("Error hanging")
+		tm.release(w, token, STOPPED)
 		return
 	}
 
-	hang, hangErr := w.Client.HGet(ctx, tm.Key, "Hang").Int()
-	if hangErr == nil {
-		// Check to make sure since should stop could of changed.
-		if !tm.Stopped {
-			_, err := tm.vm.Run("if (typeof init === 'function') {init()}")
-			if err != nil {
-				w.Client.HSet(ctx, tm.Key, "State", CRASHED)
-				w.Client.HSet(ctx, tm.Key, "Status", DISABLED)
-				w.Client.HSet(ctx, tm.Key, "Error", err.Error())
-				w.Client.HSet(ctx, tm.Key, "ErrorTime", time.Now())
-				log.WithError(err).Error("Error running init() in script " + tm.Key)
-				return
-			}
+	if !tm.load(w, token) {
+		return
+	}
+	time.Sleep(time.Duration(hang))
 
-			time.Sleep(time.Duration(hang))
+	scaledDown := false
+	for w.isHealthy() && !tm.isStopped() {
+		//If we aren't the owner anymore don't run it.
+		if !tm.renew(w, token) {
+			log.Warn("Lost ownership of thread ", tm.Key)
+			tm.setStopped(true)
+			continue
 		}
 
-		for w.Healthy && !tm.Stopped {
-			w.Client.HSet(ctx, tm.Key, "Heartbeat", time.Now().UnixNano())
-
-			//Get status and stop if disabled.
-			status := tm.getStatus(w)
-			owner := tm.getOwner(w)
-			//If script has been disabled don't run it.
-			if status == DISABLED {
-				log.Warn(tm.Key, "Was disabled.  Stopping thread.")
-				w.Client.HSet(ctx, tm.Key, "State", STOPPED)
-				tm.Stopped = true
-				continue
-			}
+		fields := w.Client.HMGet(ctx, tm.definition(), "Status", "SourceVersion", "Replicas", "Source", "Partitions").Val()
+		//If script has been disabled don't run it.
+		if fields[0] == DISABLED {
+			log.Warn(tm.Key, "Was disabled.  Stopping thread.")
+			tm.release(w, token, STOPPED)
+			tm.setStopped(true)
+			continue
+		}
 
-			//If we aren't the owner anymore don't run it.
-			if owner != w.WorkerName {
-				tm.Stopped = true
-				continue
+		replicas := parseReplicas(fields[2])
+		if partitions, _ := fields[4].(string); partitions != "" && partitions != "0" {
+			replicas = getReplicas(w, tm.definition())
+		}
+		if tm.Instance >= replicas {
+			log.Info("Thread ", tm.definition(), " was scaled down, stopping instance ", tm.Instance)
+			scaledDown = true
+			tm.setStopped(true)
+			continue
+		}
+		if replicas != tm.replicas {
+			tm.setReplicas(replicas)
+		}
+
+		//Pick up new source before running main again, whether it was saved as
+		//a version or written straight to Source.
+		version, _ := fields[1].(string)
+		source, _ := fields[3].(string)
+		changed := (version != "" && version != tm.version) || (source != "" && sourceVersion(source) != tm.version)
+		if tm.takeReloadRequest() || changed {
+			if !tm.reload(w, token) {
+				return
 			}
+		}
 
-			// Check to make sure since should stop could of changed.
-			if !tm.Stopped {
-				_, err := tm.vm.Run("if (typeof main === 'function') {main()}")
-				if err != nil {
-					w.Client.HSet(ctx, tm.Key, "State", CRASHED)
-					w.Client.HSet(ctx, tm.Key, "Status", DISABLED)
-					w.Client.HSet(ctx, tm.Key, "Error", err.Error())
-					w.Client.HSet(ctx, tm.Key, "ErrorTime", time.Now())
-					log.WithError(err).Error("Error running main() in script " + tm.Key)
-					return
-				}
-
-				time.Sleep(time.Duration(hang))
+		if leader := w.isLeader(); !tm.isStopped() && leader != tm.leader {
+			tm.leader = leader
+			if !tm.runHook(w, token, PHASELEADERSHIP, "onLeadershipChange", "worker.IsLeader()") {
+				return
 			}
 		}
+		if !tm.isStopped() && tm.updatePartitions(w) {
+			if !tm.runHook(w, token, PHASEPARTITIONS, "onPartitionsChange", "thread.Partitions()") {
+				return
+			}
+		}
+
+		// Check to make sure since should stop could of changed.
+		if !tm.isStopped() {
+			start := time.Now()
+			_, err := runScript(tm.getVM(), "if (typeof main === 'function') {main()}", tm.mainTimeout)
+			w.metrics.add("hats_thread_iterations_total", "Times main() was run.", 1, "task", tm.Key)
+			w.metrics.observe("hats_thread_main_duration_seconds", "Time taken by main().", time.Since(start), "task", tm.Key)
+			if err != nil && err != errInterrupted {
+				tm.crash(w, token, PHASEMAIN, err)
+				log.WithError(err).Error("Error running main() in script " + tm.Key)
+				return
+			}
+			tm.forgiveRestarts(w)
 
-		//Thread has ended, run any cleanup there might be.
-		_, err := tm.vm.Run("if (typeof cleanup === 'function') {cleanup()}")
-		if err != nil {
-			log.WithError(err).Error("Error cleaning up thread: ", tm.Key)
+			time.Sleep(time.Duration(hang))
 		}
+	}
 
-	} else {
-		log.WithError(hangErr).Error("Error hanging")
+	//Thread has ended, run any cleanup there might be.
+	tm.cleanup(w)
+	if tm.release(w, token, STOPPED) && scaledDown {
+		w.Client.Del(ctx, tm.Key)
+		forgetThread(w, tm.Key)
 	}
-	w.Client.HSet(ctx, tm.Key, "State", STOPPED)
 }
@@ -0,0 +1,959 @@
+package worker
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestWorker(mr *miniredis.Miniredis, name string) *worker {
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+		DB:   0, // use default DB
+	})
+	return &worker{RedisAddr: mr.Addr(), Client: client, Cluster: "TestCluster",
+		WorkerName: name, Healthy: true, SecondsTillDead: 1, metrics: newMetricsRegistry()}
+}
+
+// shareConnection points workers at a single connection.  miniredis lets go of
+// its lock while a script runs, so tests racing scripts against each other use
+// this to get the one script at a time that Redis guarantees.
+func shareConnection(mr *miniredis.Miniredis, workers ...*worker) {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), PoolSize: 1})
+	for i := range workers {
+		workers[i].Client = client
+	}
+}
+
+// stopTestWorker drains a worker and waits for its threads and jobs to hand
+// themselves back, so nothing is left talking to miniredis once it closes.
+func stopTestWorker(w *worker) {
+	w.Shutdown()
+	w.running.Wait()
+}
+
+func addTestThread(mr *miniredis.Miniredis, key string, state string) {
+	mr.HSet(key, "Source", "function main() {}")
+	mr.HSet(key, "Status", ENABLED)
+	mr.HSet(key, "State", state)
+	mr.HSet(key, "Heartbeat", "0")
+	mr.HSet(key, "Hang", "1")
+	mr.HSet(key, "DeadSeconds", "1")
+}
+
+func TestThreadAcquiredExactlyOnceUnderContention(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:contended"
+	addTestThread(mr, key, STOPPED)
+
+	workers := make([]*worker, 10)
+	for i := range workers {
+		workers[i] = newTestWorker(mr, "worker"+string(rune('a'+i)))
+	}
+	shareConnection(mr, workers...)
+	tokens := make(chan int64, len(workers))
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		w := w
+		tm := &ThreadMeta{Key: key, Stopped: true}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := tm.acquire(w)
+			if err != nil {
+				t.Errorf("Error acquiring thread: %v", err)
+			}
+			tokens <- token
+		}()
+	}
+	wg.Wait()
+	close(tokens)
+
+	owners := 0
+	for token := range tokens {
+		if token > 0 {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Errorf("Expected exactly one owner, got %d", owners)
+	}
+	if mr.HGet(key, "State") != RUNNING {
+		t.Errorf("Thread was not marked running.")
+	}
+	if mr.HGet(key, "Token") != "1" {
+		t.Errorf("Expected token 1, got %s", mr.HGet(key, "Token"))
+	}
+}
+
+func TestThreadNotAcquiredWhileLeaseValid(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:leased"
+	addTestThread(mr, key, STOPPED)
+
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+
+	token, _ := (&ThreadMeta{Key: key}).acquire(first)
+	if token == 0 {
+		t.Fatalf("First worker failed to acquire thread.")
+	}
+	token, _ = (&ThreadMeta{Key: key}).acquire(second)
+	if token != 0 {
+		t.Errorf("Second worker acquired a thread with a valid lease.")
+	}
+}
+
+func TestThreadReacquiredAfterLeaseExpires(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:expired"
+	addTestThread(mr, key, STOPPED)
+
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	firstMeta := &ThreadMeta{Key: key}
+	secondMeta := &ThreadMeta{Key: key}
+
+	firstToken, _ := firstMeta.acquire(first)
+	mr.HSet(key, "LeaseExpires", "1")
+
+	secondToken, _ := secondMeta.acquire(second)
+	if secondToken <= firstToken {
+		t.Fatalf("Expected a newer token after lease expired, got %d after %d", secondToken, firstToken)
+	}
+	if mr.HGet(key, "Owner") != "second" {
+		t.Errorf("Owner was not updated.")
+	}
+	if firstMeta.renew(first, firstToken) {
+		t.Errorf("Stale owner was able to renew its lease.")
+	}
+	if firstMeta.release(first, firstToken, STOPPED) {
+		t.Errorf("Stale owner was able to release the thread.")
+	}
+	if !secondMeta.renew(second, secondToken) {
+		t.Errorf("Current owner failed to renew its lease.")
+	}
+}
+
+func TestThreadNotAcquiredWhenDisabled(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:disabled"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Status", DISABLED)
+
+	token, _ := (&ThreadMeta{Key: key}).acquire(newTestWorker(mr, "worker"))
+	if token != 0 {
+		t.Errorf("Acquired a disabled thread.")
+	}
+}
+
+func TestRunningThreadAbortsWhenTokenChanges(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:fenced"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function main() { while (true) {} }")
+
+	w := newTestWorker(mr, "worker")
+	defer stopTestWorker(w)
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mr.HSet(key, "Token", "99")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !tm.isStopped() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tm.isStopped() {
+		t.Errorf("Thread kept running after losing its token.")
+	}
+	if mr.HGet(key, "State") != RUNNING {
+		t.Errorf("Stale owner changed the thread state.")
+	}
+}
+
+func TestRunningThreadReloadsChangedSource(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:reload"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function main() { redis.Do('set', 'out', 'old') }")
+
+	w := newTestWorker(mr, "worker")
+	defer stopTestWorker(w)
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+
+	newSource := "function init() { redis.Do('set', 'out', 'new') }"
+	time.Sleep(100 * time.Millisecond)
+	mr.HSet(key, "Source", newSource)
+	mr.HSet(key, "SourceVersion", sourceVersion(newSource))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.HGet(key, "DeployedVersion") != sourceVersion(newSource) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mr.HGet(key, "DeployedVersion") != sourceVersion(newSource) {
+		t.Fatalf("New source was not deployed.")
+	}
+	if value, _ := mr.Get("out"); value != "new" {
+		t.Errorf("Expected reloaded init() to run, got %s", value)
+	}
+	if mr.HGet(key, "Owner") != "worker" || tm.isStopped() {
+		t.Errorf("Thread gave up ownership while reloading.")
+	}
+}
+
+func TestStoppedThreadNotTakenUntilCleanupEnds(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:slowCleanup"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function init() { redis.Do('incr', 'inits') } "+
+		"function cleanup() { var until = Date.now() + 300; while (Date.now() < until) {} redis.Do('incr', 'cleanups') }")
+
+	w := newTestWorker(mr, "worker")
+	defer stopTestWorker(w)
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tm.stop(w)
+	if tm.take(w) {
+		t.Errorf("Thread was taken again while its last run was cleaning up.")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !tm.take(w) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if inits, _ := mr.Get("inits"); inits != "2" {
+		t.Errorf("Expected init() to run twice, ran %s times", inits)
+	}
+	if cleanups, _ := mr.Get("cleanups"); cleanups != "1" {
+		t.Errorf("Expected cleanup() to run once, ran %s times", cleanups)
+	}
+	if tm.isStopped() || mr.HGet(key, "State") != RUNNING || mr.HGet(key, "Owner") != "worker" {
+		t.Errorf("Thread was not running again, state %s", mr.HGet(key, "State"))
+	}
+}
+
+func TestRunningThreadReloadsEditedSource(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:edited"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function main() { redis.Do('set', 'out', 'old') }")
+
+	w := newTestWorker(mr, "worker")
+	defer stopTestWorker(w)
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+
+	//Only Source is written, as an operator editing the hash would.
+	newSource := "function main() { redis.Do('set', 'out', 'new') }"
+	time.Sleep(100 * time.Millisecond)
+	mr.HSet(key, "Source", newSource)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.HGet(key, "DeployedVersion") != sourceVersion(newSource) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mr.HGet(key, "DeployedVersion") != sourceVersion(newSource) {
+		t.Fatalf("Edited source was not deployed.")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if value, _ := mr.Get("out"); value != "new" {
+		t.Errorf("Expected the edited main() to run, got %s", value)
+	}
+}
+
+func TestRestartBackoffGrowsWithinBounds(t *testing.T) {
+	for restarts := 0; restarts < 10; restarts++ {
+		delay := restartBackoff(restarts, time.Second, time.Minute)
+		max := time.Second << uint(restarts)
+		if max > time.Minute {
+			max = time.Minute
+		}
+		if delay < max/2 || delay > max {
+			t.Errorf("Backoff %v for %d restarts outside %v-%v", delay, restarts, max/2, max)
+		}
+	}
+}
+
+func TestCrashedThreadRestartsAfterBackoff(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:restart"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "RestartPolicy", RESTARTONFAILURE)
+	mr.HSet(key, "MaxRetries", "1")
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key}
+
+	token, _ := tm.acquire(w)
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	if mr.HGet(key, "State") != CRASHED || mr.HGet(key, "Status") == DISABLED {
+		t.Fatalf("Crashed thread was not left to restart.")
+	}
+	if mr.HGet(key, "RestartCount") != "1" {
+		t.Errorf("Restart was not counted.")
+	}
+	if token, _ := tm.acquire(w); token != 0 {
+		t.Errorf("Crashed thread was taken before its backoff passed.")
+	}
+
+	mr.HSet(key, "NextAttempt", "1")
+	token, _ = tm.acquire(w)
+	if token == 0 {
+		t.Fatalf("Crashed thread was not taken after its backoff passed.")
+	}
+
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	if mr.HGet(key, "State") != CRASHLOOP || mr.HGet(key, "Status") != DISABLED {
+		t.Errorf("Thread out of retries was not put in a crash loop.")
+	}
+}
+
+func TestThreadLeftMidCrashIsTakenAgain(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:midCrash"
+	addTestThread(mr, key, STOPPED)
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key}
+
+	//The worker died while handling the crash, before the thread was handed
+	//back, so it is still running under an expired lease.
+	token, _ := tm.acquire(w)
+	mr.HSet(key, "Owner", "dead")
+	mr.HSet(key, "LeaseExpires", "1")
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	if mr.HGet(key, "State") != RUNNING {
+		t.Fatalf("Crash was handled by a worker that doesn't own the thread.")
+	}
+	if token, _ := tm.acquire(w); token == 0 {
+		t.Errorf("Thread left part way through a crash was not taken again.")
+	}
+
+	//Crashes handled before the restart was written in one step.
+	mr.HSet(key, "State", CRASHED)
+	mr.HSet(key, "NextAttempt", "-1")
+	if token, _ := tm.acquire(w); token == 0 {
+		t.Errorf("Thread left with a crash placeholder was not taken again.")
+	}
+}
+
+func TestCrashedThreadRestartsWhenEnabledAgain(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:reenabled"
+	addTestThread(mr, key, STOPPED)
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key}
+
+	token, _ := tm.acquire(w)
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	mr.HSet(key, "Status", ENABLED)
+	token, _ = tm.acquire(w)
+	if token == 0 {
+		t.Fatalf("Crashed thread was not taken after being enabled again.")
+	}
+
+	mr.HSet(key, "RestartPolicy", RESTARTONFAILURE)
+	mr.HSet(key, "MaxRetries", "0")
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	if mr.HGet(key, "State") != CRASHLOOP || mr.HGet(key, "Status") != DISABLED {
+		t.Fatalf("Thread out of retries was not put in a crash loop.")
+	}
+	mr.HSet(key, "Status", ENABLED)
+	if token, _ := tm.acquire(w); token == 0 {
+		t.Errorf("Crash looping thread was not taken after being enabled again.")
+	}
+	if mr.HGet(key, "RestartCount") != "0" {
+		t.Errorf("Restart count was not cleared when the thread was enabled again.")
+	}
+}
+
+func TestCrashedThreadDisabledByDefault(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:never"
+	addTestThread(mr, key, STOPPED)
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key}
+
+	token, _ := tm.acquire(w)
+	tm.crash(w, token, PHASEMAIN, errInterrupted)
+	if mr.HGet(key, "Status") != DISABLED {
+		t.Errorf("Crashed thread without a restart policy was not disabled.")
+	}
+}
+
+func TestDrainRunsCleanupAndHandsThreadBack(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:drained"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function main() { while (true) {} } function cleanup() { redis.Do('set', 'out', 'clean') }")
+
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	w.Drain(2 * time.Second)
+	if value, _ := mr.Get("out"); value != "clean" {
+		t.Errorf("cleanup() did not run before the drain finished.")
+	}
+	if mr.HGet(key, "State") != STOPPED || mr.HGet(key, "LeaseExpires") != "0" {
+		t.Errorf("Thread was not handed back, state %s", mr.HGet(key, "State"))
+	}
+	if mr.HGet(workerKey(w), "State") != OFFLINE {
+		t.Errorf("Worker was not marked offline.")
+	}
+	if tm.take(w) {
+		t.Errorf("Draining worker took a thread.")
+	}
+}
+
+func TestDrainingWorkerIsNotReclaimed(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	mr.HSet("TestCluster:Settings", "WorkerTimeout", "300ms")
+	key := "TestCluster:Threads:finishing"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function cleanup() { var until = Date.now() + 800; while (Date.now() < until) {} }")
+	mr.SetAdd("TestCluster:Index:Threads", key)
+
+	leader := newTestWorker(mr, "leader")
+	Heartbeat(leader)
+	Elect(leader)
+	w := newTestWorker(mr, "worker")
+	addLiveWorker(mr, w)
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+	time.Sleep(100 * time.Millisecond)
+	token := mr.HGet(key, "Token")
+
+	drained := make(chan struct{})
+	go func() {
+		w.Drain(2 * time.Second)
+		close(drained)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	Heartbeat(leader)
+	CheckWorkers(leader)
+	if mr.HGet(key, "Token") != token || mr.HGet(workerKey(w), "State") == OFFLINE {
+		t.Errorf("Leader reclaimed the thread of a worker that is still draining.")
+	}
+	<-drained
+}
+
+func TestDrainTimeoutHandsThreadBack(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:stuck"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Source", "function main() { while (true) {} } function cleanup() { while (true) {} }")
+
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: key, Stopped: true}
+	w.threads = map[string]*ThreadMeta{key: tm}
+	if !tm.take(w) {
+		t.Fatalf("Failed to take thread.")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	w.Drain(300 * time.Millisecond)
+	if mr.HGet(key, "State") != STOPPED || mr.HGet(key, "LeaseExpires") != "0" {
+		t.Errorf("Thread was not handed back after the drain timed out, state %s", mr.HGet(key, "State"))
+	}
+	w.running.Wait()
+}
+
+func TestDeadWorkerIsReclaimed(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "alive")
+	Heartbeat(w)
+	Elect(w)
+
+	thread := "TestCluster:Threads:orphan"
+	addTestThread(mr, thread, RUNNING)
+	mr.HSet(thread, "Owner", "dead")
+	mr.HSet(thread, "Token", "4")
+	mr.HSet(thread, "LeaseExpires", strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10))
+	mr.SetAdd("TestCluster:Index:Threads", thread)
+	other := "TestCluster:Threads:other"
+	addTestThread(mr, other, RUNNING)
+	mr.HSet(other, "Owner", "alive")
+	mr.SetAdd("TestCluster:Index:Threads", other)
+	job := "TestCluster:Jobs:orphan"
+	mr.HSet(job, "State", RUNNING)
+	mr.HSet(job, "Owner", "dead")
+	mr.SetAdd("TestCluster:Index:Jobs", job)
+
+	mr.HSet("TestCluster:workers:dead", "State", ONLINE)
+	mr.HSet("TestCluster:workers:dead", "Heartbeat", strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10))
+	mr.HSet("TestCluster:workers:gone", "State", OFFLINE)
+	mr.HSet("TestCluster:workers:gone", "Heartbeat", strconv.FormatInt(time.Now().Add(-48*time.Hour).UnixNano(), 10))
+	mr.SetAdd("TestCluster:Index:Workers", "dead", "gone")
+
+	CheckWorkers(w)
+
+	if mr.HGet("TestCluster:workers:dead", "State") != OFFLINE {
+		t.Errorf("Dead worker was not marked offline.")
+	}
+	if mr.HGet(thread, "State") != STOPPED || mr.HGet(thread, "Token") != "5" {
+		t.Errorf("Dead worker's thread was not released and fenced.")
+	}
+	if mr.HGet(other, "State") != RUNNING {
+		t.Errorf("A live worker's thread was released.")
+	}
+	if mr.HGet(job, "State") != STOPPED || mr.HGet(job, "Owner") != "" {
+		t.Errorf("Dead worker's job was not released.")
+	}
+	if mr.Exists("TestCluster:workers:gone") {
+		t.Errorf("Old offline worker was not pruned.")
+	}
+	if ok, _ := mr.IsMember("TestCluster:Index:Workers", "alive"); !ok {
+		t.Errorf("Live worker dropped out of the index.")
+	}
+
+	//The thread is free for another worker straight away.
+	tm := &ThreadMeta{Key: thread, Stopped: true}
+	w.threads = map[string]*ThreadMeta{thread: tm}
+	if !tm.take(w) {
+		t.Errorf("Released thread could not be taken.")
+	}
+	stopTestWorker(w)
+}
+
+func TestDeadWorkerIsReclaimedInBatches(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "alive")
+	Heartbeat(w)
+	Elect(w)
+
+	threads := make([]string, reclaimBatch+20)
+	for i := range threads {
+		threads[i] = "TestCluster:Threads:orphan" + strconv.Itoa(i)
+		mr.HSet(threads[i], "State", RUNNING)
+		mr.HSet(threads[i], "Owner", "dead")
+		mr.SetAdd("TestCluster:Index:Threads", threads[i])
+	}
+	jobs := make([]string, reclaimBatch)
+	for i := range jobs {
+		jobs[i] = "TestCluster:Jobs:orphan" + strconv.Itoa(i)
+		mr.HSet(jobs[i], "State", RUNNING)
+		mr.HSet(jobs[i], "Owner", "dead")
+		mr.SetAdd("TestCluster:Index:Jobs", jobs[i])
+	}
+	mr.HSet("TestCluster:workers:dead", "State", ONLINE)
+	mr.HSet("TestCluster:workers:dead", "Heartbeat", strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10))
+	mr.SetAdd("TestCluster:Index:Workers", "dead")
+
+	CheckWorkers(w)
+
+	if mr.HGet("TestCluster:workers:dead", "State") != OFFLINE {
+		t.Errorf("Dead worker was not marked offline.")
+	}
+	for _, key := range append(threads, jobs...) {
+		if mr.HGet(key, "State") != STOPPED || mr.HGet(key, "Owner") != "" {
+			t.Errorf("%s was not released.", key)
+		}
+	}
+	stopTestWorker(w)
+}
+
+func TestMatchSelector(t *testing.T) {
+	labels := parseLabels("zone=east, disk=ssd,gpu")
+	cases := map[string]bool{
+		"":                     true,
+		"zone=east":            true,
+		"zone=west":            false,
+		"zone=east,disk=ssd":   true,
+		"zone=east,disk=spin":  false,
+		"gpu":                  true,
+		"!gpu":                 false,
+		"!arm":                 true,
+		"disk!=spin":           true,
+		"disk!=ssd":            false,
+		"arm=":                 false,
+		"zone=east, gpu, !arm": true,
+	}
+	for selector, expected := range cases {
+		if matchSelector(selector, labels) != expected {
+			t.Errorf("Selector %q should be %v", selector, expected)
+		}
+	}
+}
+
+func TestThreadPlacementFollowsLabels(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:placed"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "RequiredLabels", "zone=east")
+	mr.HSet(key, "PreferredLabels", "disk=ssd")
+
+	west := newTestWorker(mr, "west")
+	west.Labels = parseLabels("zone=west,disk=ssd")
+	east := newTestWorker(mr, "east")
+	east.Labels = parseLabels("zone=east")
+	fast := newTestWorker(mr, "fast")
+	fast.Labels = parseLabels("zone=east,disk=ssd")
+
+	if canPlace(west, getPlacement(west, key), liveWorkers(west)) {
+		t.Errorf("Worker without the required labels can take the thread.")
+	}
+	if !canPlace(east, getPlacement(east, key), liveWorkers(east)) {
+		t.Errorf("Worker with the required labels can't take the thread when nobody is preferred.")
+	}
+
+	mr.HSet(workerKey(fast), "State", ONLINE)
+	mr.HSet(workerKey(fast), "Labels", encodeLabels(fast.Labels))
+	Heartbeat(fast)
+	if canPlace(east, getPlacement(east, key), liveWorkers(east)) {
+		t.Errorf("Worker took the thread from a live preferred worker.")
+	}
+	if !canPlace(fast, getPlacement(fast, key), liveWorkers(fast)) {
+		t.Errorf("Preferred worker can't take the thread.")
+	}
+
+	mr.HSet(workerKey(fast), "Healthy", "false")
+	if !canPlace(east, getPlacement(east, key), liveWorkers(east)) {
+		t.Errorf("Worker held off for an unhealthy preferred worker.")
+	}
+}
+
+func TestReplicaPlacementFollowsLabels(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:placedReplicas"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Replicas", "2")
+	mr.HSet(key, "RequiredLabels", "zone=west")
+	mr.SetAdd("TestCluster:Index:Threads", key)
+
+	east := newTestWorker(mr, "east")
+	east.Labels = parseLabels("zone=east")
+	CheckThreads(east)
+	for _, instance := range threadInstanceKeys(east, key) {
+		if mr.HGet(instance, "Owner") == "east" {
+			t.Errorf("Worker without the required labels took replica %s.", instance)
+		}
+	}
+	stopTestWorker(east)
+
+	west := newTestWorker(mr, "west")
+	west.Labels = parseLabels("zone=west")
+	CheckThreads(west)
+	for _, instance := range threadInstanceKeys(west, key) {
+		if mr.HGet(instance, "Owner") != "west" {
+			t.Errorf("Worker with the required labels did not take replica %s.", instance)
+		}
+	}
+	stopTestWorker(west)
+}
+
+func TestThreadsSpreadAcrossWorkers(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	for i := 0; i < 4; i++ {
+		key := "TestCluster:Threads:spread" + strconv.Itoa(i)
+		addTestThread(mr, key, STOPPED)
+		mr.SetAdd("TestCluster:Index:Threads", key)
+	}
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	second.MaxThreads = 1
+	for _, w := range []*worker{first, second} {
+		mr.HSet(workerKey(w), "State", ONLINE)
+		Heartbeat(w)
+		defer stopTestWorker(w)
+	}
+
+	for round := 0; round < 4; round++ {
+		CheckThreads(first)
+		CheckThreads(second)
+	}
+	firstLoad, _ := localLoad(first)
+	secondLoad, _ := localLoad(second)
+	if secondLoad != 1 {
+		t.Errorf("Worker with room for one thread is running %d", secondLoad)
+	}
+	if firstLoad != 3 {
+		t.Errorf("Expected the rest of the threads on the other worker, got %d", firstLoad)
+	}
+	if mr.HGet(workerKey(first), "ThreadLoad") != "3" {
+		t.Errorf("Load was not published.")
+	}
+}
+
+func TestOverloadedWorkerHandsBackAThread(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	busy := newTestWorker(mr, "busy")
+	idle := newTestWorker(mr, "idle")
+	for _, w := range []*worker{busy, idle} {
+		mr.HSet(workerKey(w), "State", ONLINE)
+		Heartbeat(w)
+	}
+	defer stopTestWorker(busy)
+	busy.threads = make(map[string]*ThreadMeta)
+	for i := 0; i < 3; i++ {
+		key := "TestCluster:Threads:busy" + strconv.Itoa(i)
+		addTestThread(mr, key, STOPPED)
+		tm := &ThreadMeta{Key: key, Stopped: true}
+		busy.threads[key] = tm
+		if !tm.take(busy) {
+			t.Fatalf("Failed to take thread.")
+		}
+	}
+
+	rebalanceThreads(busy, liveWorkers(busy))
+	time.Sleep(200 * time.Millisecond)
+	if load, _ := localLoad(busy); load != 2 {
+		t.Errorf("Expected one thread to be handed back, running %d", load)
+	}
+
+	//A load of 4 against 2 isn't worth moving a thread of weight 2.
+	for _, tm := range busy.threads {
+		tm.placement.Weight = 2
+	}
+	mr.HSet(workerKey(idle), "ThreadLoad", "2")
+	rebalanceThreads(busy, liveWorkers(busy))
+	time.Sleep(200 * time.Millisecond)
+	if load, _ := localLoad(busy); load != 4 {
+		t.Errorf("Thread was moved although it would bounce back, load %d", load)
+	}
+}
+
+func TestReplicasRunAndScaleDown(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:replicated"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Replicas", "3")
+	mr.HSet(key, "Source", "function init() { redis.Do('sadd', 'started', thread.Instance + '/' + thread.Replicas) }")
+	mr.SetAdd("TestCluster:Index:Threads", key)
+
+	w := newTestWorker(mr, "worker")
+	defer stopTestWorker(w)
+	CheckThreads(w)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if n, _ := mr.Members("started"); len(n) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, member := range []string{"0/3", "1/3", "2/3"} {
+		if ok, _ := mr.IsMember("started", member); !ok {
+			t.Errorf("Instance %s did not start", member)
+		}
+	}
+	if mr.HGet(instanceKey(key, 1), "Owner") != "worker" || mr.HGet(instanceKey(key, 1), "State") != RUNNING {
+		t.Errorf("Replica does not have its own ownership.")
+	}
+
+	mr.HSet(key, "Replicas", "1")
+	deadline = time.Now().Add(2 * time.Second)
+	for (mr.Exists(instanceKey(key, 1)) || mr.Exists(instanceKey(key, 2))) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mr.Exists(instanceKey(key, 1)) || mr.Exists(instanceKey(key, 2)) {
+		t.Errorf("Scaled down replicas were not removed.")
+	}
+	if mr.HGet(key, "State") != RUNNING {
+		t.Errorf("First instance stopped when scaling down.")
+	}
+	if threads := getThreads(w); len(threads) != 1 {
+		t.Errorf("Expected one instance left, got %d", len(threads))
+	}
+}
+
+func TestAssignPartitionsMovesFewPartitions(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	before := assignPartitions(members, 64)
+	owners := make(map[int]string)
+	for member, partitions := range before {
+		for _, partition := range partitions {
+			if _, ok := owners[partition]; ok {
+				t.Errorf("Partition %d assigned twice", partition)
+			}
+			owners[partition] = member
+		}
+	}
+	if len(owners) != 64 {
+		t.Errorf("Expected 64 partitions assigned, got %d", len(owners))
+	}
+
+	after := assignPartitions(append(members, "d"), 64)
+	if len(after["d"]) == 0 {
+		t.Errorf("New member got no partitions")
+	}
+	for _, member := range members {
+		for _, partition := range after[member] {
+			if owners[partition] != member {
+				t.Errorf("Partition %d moved from %s to %s", partition, owners[partition], member)
+			}
+		}
+	}
+}
+
+// addLiveWorker makes a worker look online to its peers.
+func addLiveWorker(mr *miniredis.Miniredis, w *worker) {
+	mr.HSet(workerKey(w), "State", ONLINE)
+	mr.HSet(workerKey(w), "Labels", encodeLabels(w.Labels))
+	Heartbeat(w)
+}
+
+func TestPartitionsSplitBetweenWorkers(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:partitioned"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Partitions", "8")
+	mr.HSet(key, "DeadSeconds", "10")
+
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	addLiveWorker(mr, first)
+	addLiveWorker(mr, second)
+	if replicas := getReplicas(first, key); replicas != 2 {
+		t.Fatalf("Expected an instance for each live worker, got %d", replicas)
+	}
+	a := &ThreadMeta{Key: instanceKey(key, 0), Definition: key}
+	b := &ThreadMeta{Key: instanceKey(key, 1), Definition: key, Instance: 1}
+	a.token, _ = a.acquire(first)
+	b.token, _ = b.acquire(second)
+
+	if !a.updatePartitions(first) || !b.updatePartitions(second) {
+		t.Fatalf("Expected both workers to get partitions")
+	}
+	held := append(a.getPartitions(), b.getPartitions()...)
+	if len(held) != 8 || len(a.getPartitions()) == 0 || len(b.getPartitions()) == 0 {
+		t.Errorf("Partitions not split between workers: %v %v", a.getPartitions(), b.getPartitions())
+	}
+	if a.updatePartitions(first) {
+		t.Errorf("Partitions changed without membership changing")
+	}
+
+	//The second worker stops, its partitions go to the first once handed back.
+	b.release(second, b.token, STOPPED)
+	a.updatePartitions(first)
+	if len(a.getPartitions()) == 8 {
+		t.Errorf("Took partitions still leased by the previous owner")
+	}
+	b.releaseAllPartitions(second)
+	a.updatePartitions(first)
+	if len(a.getPartitions()) != 8 {
+		t.Errorf("Expected first worker to hold every partition, got %v", a.getPartitions())
+	}
+}
+
+func TestPartitionedThreadRunsOnEveryWorker(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Threads:spread"
+	addTestThread(mr, key, STOPPED)
+	mr.HSet(key, "Partitions", "8")
+	mr.HSet(key, "RequiredLabels", "zone=east")
+	mr.SetAdd("TestCluster:Index:Threads", key)
+
+	workers := []*worker{newTestWorker(mr, "first"), newTestWorker(mr, "second"), newTestWorker(mr, "west")}
+	workers[0].Labels = parseLabels("zone=east")
+	workers[1].Labels = parseLabels("zone=east")
+	workers[2].Labels = parseLabels("zone=west")
+	for i := range workers {
+		addLiveWorker(mr, workers[i])
+		defer stopTestWorker(workers[i])
+	}
+	for round := 0; round < 2; round++ {
+		for i := range workers {
+			CheckThreads(workers[i])
+		}
+	}
+
+	owners := map[string]int{}
+	for _, instance := range threadInstanceKeys(workers[0], key) {
+		owners[mr.HGet(instance, "Owner")]++
+	}
+	if len(owners) != 2 || owners["first"] != 1 || owners["second"] != 1 {
+		t.Errorf("Expected one instance on each east worker, got %v", owners)
+	}
+}
+
+func TestOneLeaderAtATime(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	mr.HSet("TestCluster:Settings", "LeaderLease", "100ms")
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+
+	Elect(first)
+	Elect(second)
+	if !first.isLeader() || second.isLeader() {
+		t.Fatalf("Expected only the first worker to lead")
+	}
+	if mr.HGet("TestCluster:Leader", "Name") != "first" {
+		t.Errorf("Leader not recorded in the cluster.")
+	}
+
+	//The first worker stalls, the second takes over once the lease runs out.
+	time.Sleep(150 * time.Millisecond)
+	if first.isLeader() {
+		t.Errorf("Leadership outlived its lease.")
+	}
+	Elect(second)
+	if !second.isLeader() {
+		t.Fatalf("Second worker did not take over.")
+	}
+
+	//The old leader's token no longer works.
+	mr.HSet("TestCluster:workers:dead", "State", ONLINE)
+	mr.HSet("TestCluster:workers:dead", "Heartbeat", "1")
+	first.leaderExpires = time.Now().Add(time.Minute)
+	reclaimWorker(first, "dead", time.Now())
+	if mr.HGet("TestCluster:workers:dead", "State") != ONLINE {
+		t.Errorf("Stale leader reclaimed a worker.")
+	}
+
+	Resign(second)
+	Elect(first)
+	if !first.isLeader() || second.isLeader() {
+		t.Errorf("Leadership was not handed over after resigning.")
+	}
+}
@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// versionKey is where a single immutable version of a task's source lives.
+func versionKey(key string, version string) string {
+	return key + ":Versions:" + version
+}
+
+// versionHistoryKey lists the versions of a task, newest first.
+func versionHistoryKey(key string) string {
+	return key + ":Versions"
+}
+
+// taskKind returns the kind of task a key belongs to.
+func taskKind(w *worker, key string) string {
+	kind := strings.SplitN(strings.TrimPrefix(key, w.Cluster+":"), ":", 2)[0]
+	switch kind {
+	case THREADS, JOBS, ENDPOINTS:
+		return kind
+	}
+	return ""
+}
+
+// getActiveSource returns the source of the version a task points at.  Tasks
+// written without versions fall back to their Source field.  A Source that
+// doesn't match its version was edited by hand and is saved as a new version.
+func getActiveSource(w *worker, key string) (source string, version string) {
+	fields := w.Client.HMGet(ctx, key, "Source", "SourceVersion").Val()
+	source, _ = fields[0].(string)
+	version, _ = fields[1].(string)
+	if source == "" {
+		if version != "" {
+			source = w.Client.HGet(ctx, versionKey(key, version), "Source").Val()
+		}
+		return
+	}
+	if edited := sourceVersion(source); edited != version {
+		if version != "" {
+			log.Info("Source of ", key, " was edited, saving it as version ", edited)
+			saveSource(w, key, source, "", "Edited in redis")
+		}
+		version = edited
+	}
+	return
+}
+
+// saveSource stores source as a new version of the task and makes it active.
+// Saving a source that already has a version just activates that version.
+func saveSource(w *worker, key string, source string, author string, message string) (string, error) {
+	kind := taskKind(w, key)
+	if kind == "" {
+		return "", errors.New("not a task key: " + key)
+	}
+
+	version := sourceVersion(source)
+	vKey := versionKey(key, version)
+	if w.Client.HSetNX(ctx, vKey, "Version", version).Val() {
+		w.Client.HMSet(ctx, vKey, "Source", source, "Author", author,
+			"Time", time.Now().UnixNano(), "Message", message)
+		w.Client.LPush(ctx, versionHistoryKey(key), version)
+	}
+
+	activateVersion(w, key, version, source, true)
+	registerTask(w, kind, key)
+	return version, nil
+}
+
+// getVersions returns the saved versions of a task, newest first.
+func getVersions(w *worker, key string) []map[string]string {
+	versions := make([]map[string]string, 0)
+	history := w.Client.LRange(ctx, versionHistoryKey(key), 0, -1).Val()
+	for i := range history {
+		version := w.Client.HGetAll(ctx, versionKey(key, history[i])).Val()
+		delete(version, "Source")
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// rollback makes an earlier version of a task active again.
+func rollback(w *worker, key string, version string) error {
+	source := w.Client.HGet(ctx, versionKey(key, version), "Source").Val()
+	if source == "" {
+		return errors.New("unknown version " + version + " of " + key)
+	}
+	log.Info("Rolling back ", key, " to version ", version)
+	activateVersion(w, key, version, source, true)
+	return nil
+}
+
+// activateVersion points a task at version.  When keepPrevious is set the
+// version being replaced is remembered so it can be rolled back to, activating
+// the version already active leaves it as it was.
+func activateVersion(w *worker, key string, version string, source string, keepPrevious bool) {
+	current := w.Client.HGet(ctx, key, "SourceVersion").Val()
+	fields := []interface{}{"Source", source, "SourceVersion", version, "VersionTime", time.Now().UnixNano()}
+	if !keepPrevious {
+		fields = append(fields, "PreviousVersion", "")
+	} else if current != version {
+		fields = append(fields, "PreviousVersion", current)
+	}
+	w.Client.HMSet(ctx, key, fields...)
+	publishEvent(w, SOURCECHANGED, key)
+}
+
+// autoRollback rolls a task that failed back to its previous version if the
+// current version was deployed within its RollbackWindow.  Returns true if it
+// rolled back.
+func autoRollback(w *worker, key string) bool {
+	window := getTaskDuration(w, key, "RollbackWindow")
+	if window <= 0 {
+		return false
+	}
+
+	fields := w.Client.HMGet(ctx, key, "SourceVersion", "PreviousVersion", "VersionTime").Val()
+	current, _ := fields[0].(string)
+	previous, _ := fields[1].(string)
+	deployedString, _ := fields[2].(string)
+	deployed, _ := strconv.ParseInt(deployedString, 10, 64)
+	if previous == "" || previous == current || time.Since(time.Unix(0, deployed)) > window {
+		return false
+	}
+
+	source := w.Client.HGet(ctx, versionKey(key, previous), "Source").Val()
+	if source == "" {
+		return false
+	}
+	log.Warn("Version ", current, " of ", key, " failed, rolling back to ", previous)
+	//Don't remember the bad version so a failure after rolling back can't flip back to it.
+	activateVersion(w, key, previous, source, false)
+	w.Client.HSet(ctx, key, "RolledBackFrom", current)
+	return true
+}
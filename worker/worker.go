@@ -2,6 +2,8 @@ package worker
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +12,10 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -42,6 +47,41 @@ const STOPPED = "stopped"
 //RUNNING running
 const RUNNING = "running"
 
+//CRASHLOOP crashed more times than its restart policy allows
+const CRASHLOOP = "crashloop"
+
+//OFFLINE offline
+const OFFLINE = "offline"
+
+//DRAINING finishing its work before shutting down
+const DRAINING = "draining"
+
+//Restart policies
+
+//RESTARTNEVER disable a thread when it crashes
+const RESTARTNEVER = "never"
+
+//RESTARTONFAILURE restart a crashed thread up to MaxRetries times
+const RESTARTONFAILURE = "on-failure"
+
+//RESTARTALWAYS restart a crashed thread no matter how often it crashes
+const RESTARTALWAYS = "always"
+
+//Concurrency policies
+
+//FORBID skip a job's tick while an earlier run is still going
+const FORBID = "forbid"
+
+//ALLOW let runs of a job overlap
+const ALLOW = "allow"
+
+//REPLACE interrupt the runs still going and start the new one
+const REPLACE = "replace"
+
+const defaultMaxRetries = 5
+const defaultBackoffBase = time.Second
+const defaultBackoffMax = 5 * time.Minute
+
 var ctx = context.Background()
 
 //worker main structure for worker
@@ -59,37 +99,114 @@ type worker struct {
 	SecondsTillDead int
 	VMStopChan      chan func()
 	shuttingDown    bool
+	CPUThreshold    float64
+	MemThreshold    float64
+	HealthInterval  time.Duration
+	threadsMutex    sync.Mutex
+	indexScans      map[string]time.Time
+	indexMutex      sync.Mutex
+	wake            chan struct{}
+	jobsMutex       sync.Mutex
+	metrics         *metricsRegistry
+	started         time.Time
+	healthMutex     sync.Mutex
+	healthReason    string
+	loadAverage     float64
+	memoryUsage     float64
+	drainMutex      sync.Mutex
+	running         sync.WaitGroup
+	endpointServer  *http.Server
+	healthServer    *http.Server
+	apiServer       *http.Server
+	Labels          map[string]string
+	MaxThreads      int
+	lastRebalance   time.Time
+	leaderMutex     sync.Mutex
+	leaderToken     int64
+	leaderExpires   time.Time
+	tailOnce        sync.Once
+	tailClient      *redis.Client
+	followers       chan struct{}
 }
 
 //TaskInterface Everything we do is a task.  This the interface.
 type TaskInterface interface {
 	getVM() *otto.Otto
+	getKey() string
+}
+
+//Options Settings a worker is created with, overridden by ConfigFile when set
+type Options struct {
+	ConfigFile     string
+	RedisAddr      string
+	RedisPassword  string
+	Cluster        string
+	WorkerName     string
+	ScriptList     string
+	Host           bool
+	HostPort       string
+	HealthPort     string
+	APIPort        string
+	APIToken       string
+	CPUThreshold   float64
+	MemThreshold   float64
+	HealthInterval time.Duration
+	Labels         string
+	MaxThreads     int
 }
 
 //Create Creates a worker
-func Create(configFile string, redisAddr string, redisPassword string, cluster string, WorkerName string, scriptList string, host bool, hostPort string, healthPort string) (*worker, error) {
-	if configFile != "" {
-		fBytes, err := ioutil.ReadFile(configFile)
+func Create(options Options) (*worker, error) {
+	if options.ConfigFile != "" {
+		fBytes, err := ioutil.ReadFile(options.ConfigFile)
 		if err == nil {
 			var f interface{}
 			err2 := json.Unmarshal(fBytes, &f)
 			if err2 == nil {
 				m := f.(map[string]interface{})
-				redisAddr = m["redis-address"].(string)
-				redisPassword = m["redis-password"].(string)
-				cluster = m["cluster"].(string)
-				WorkerName = m["name"].(string)
-				host = m["host"].(bool)
+				options.RedisAddr = m["redis-address"].(string)
+				options.RedisPassword = m["redis-password"].(string)
+				options.Cluster = m["cluster"].(string)
+				options.WorkerName = m["name"].(string)
+				options.Host = m["host"].(bool)
+				if value, ok := m["cpu-threshold"].(float64); ok {
+					options.CPUThreshold = value
+				}
+				if value, ok := m["mem-threshold"].(float64); ok {
+					options.MemThreshold = value
+				}
+				if value, ok := m["health-interval"].(float64); ok {
+					options.HealthInterval = time.Duration(value * float64(time.Second))
+				}
+				if value, ok := m["labels"].(string); ok {
+					options.Labels = value
+				}
+				if value, ok := m["max-threads"].(float64); ok {
+					options.MaxThreads = int(value)
+				}
+				if value, ok := m["api-port"].(string); ok {
+					options.APIPort = value
+				}
+				if value, ok := m["api-token"].(string); ok {
+					options.APIToken = value
+				}
 			}
 		}
 	}
 
-	if len(WorkerName) == 0 {
-		WorkerName = generateRandomName(10)
+	if len(options.WorkerName) == 0 {
+		options.WorkerName = generateRandomName(10)
+	}
+	w := &worker{RedisAddr: options.RedisAddr, RedisPassword: options.RedisPassword,
+		Cluster: options.Cluster, WorkerName: options.WorkerName, ScriptList: options.ScriptList,
+		Healthy: true, SecondsTillDead: 1, CPUThreshold: options.CPUThreshold,
+		MemThreshold: options.MemThreshold, HealthInterval: options.HealthInterval,
+		wake: make(chan struct{}, 1), metrics: newMetricsRegistry(), started: time.Now(),
+		Labels: parseLabels(options.Labels), MaxThreads: options.MaxThreads}
+
+	if w.HealthInterval <= 0 {
+		w.HealthInterval = 5 * time.Second
 	}
-	w := &worker{RedisAddr: redisAddr, RedisPassword: redisPassword,
-		Cluster: cluster, WorkerName: WorkerName, ScriptList: scriptList,
-		Healthy: true, SecondsTillDead: 1}
 
 	if w.RedisAddr == "" {
 		return nil, errors.New("no redis address provided")
@@ -107,8 +224,12 @@ func Create(configFile string, redisAddr string, redisPassword string, cluster s
 		return nil, errors.New("redis failed ping")
 	}
 
-	w.Client.HSet(ctx, w.Cluster+":workers:"+w.WorkerName, "State", ONLINE)
-	w.Client.HSet(ctx, w.Cluster+":workers:"+w.WorkerName, "Status", ENABLED)
+	w.Client.HSet(ctx, workerKey(w), "State", ONLINE)
+	w.Client.HSet(ctx, workerKey(w), "Status", ENABLED)
+	w.Client.HSet(ctx, workerKey(w), "Labels", encodeLabels(w.Labels))
+	Heartbeat(w)
+	go w.monitorHealth()
+	go w.listenForEvents()
 
 	if w.ScriptList != "" {
 		err := loadScripts(w, w.ScriptList)
@@ -117,9 +238,12 @@ func Create(configFile string, redisAddr string, redisPassword string, cluster s
 		}
 	}
 
-	if host {
-		http.HandleFunc("/", w.handleEndpoint)
-		go func() { http.ListenAndServe(":"+hostPort, nil) }()
+	if options.Host {
+		w.endpointServer = &http.Server{
+			Addr:    ":" + options.HostPort,
+			Handler: http.HandlerFunc(w.handleEndpoint),
+		}
+		go func() { w.endpointServer.ListenAndServe() }()
 	}
 
 	// create `ServerMux`
@@ -135,17 +259,36 @@ func Create(configFile string, redisAddr string, redisPassword string, cluster s
 			fmt.Fprint(res, "{}")
 		}
 	})
+	mux.HandleFunc("/healthz", w.handleHealthz)
+	mux.HandleFunc("/readyz", w.handleReadyz)
+	mux.HandleFunc("/status", w.handleStatus)
+	mux.HandleFunc("/metrics", w.handleMetrics)
+	registerReadAPI(w, mux)
 
 	// create new server
-	healthServer := http.Server{
-		Addr:    fmt.Sprintf(":%v", healthPort), // :{port}
+	w.healthServer = &http.Server{
+		Addr:    fmt.Sprintf(":%v", options.HealthPort), // :{port}
 		Handler: mux,
 	}
-	go func() { healthServer.ListenAndServe() }()
+	go func() { w.healthServer.ListenAndServe() }()
+
+	if options.APIPort != "" {
+		w.apiServer = &http.Server{
+			Addr:    ":" + options.APIPort,
+			Handler: newAPIHandler(w, options.APIToken),
+		}
+		go func() { w.apiServer.ListenAndServe() }()
+	}
 
 	return w, nil
 }
 
+// sourceVersion identifies a script by its content.
+func sourceVersion(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
 func generateRandomName(length int) (out string) {
 	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 	for i := 0; i < length; i++ {
@@ -155,31 +298,205 @@ func generateRandomName(length int) (out string) {
 	return
 }
 
-//Shutdown Shutsdown the worker by safely stopping threads
+//Shutdown Puts the worker into drain mode.  It stops taking threads and jobs and
+//asks its threads to finish, which run cleanup() and hand themselves back.
 func (w *worker) Shutdown() {
+	w.drainMutex.Lock()
+	if w.shuttingDown {
+		w.drainMutex.Unlock()
+		return
+	}
 	w.shuttingDown = true
-	threads := getThreads(w)
+	w.drainMutex.Unlock()
+
+	log.Info("Draining worker ", w.WorkerName)
+	w.Client.HSet(ctx, workerKey(w), "State", DRAINING)
+	jobs := localJobs(w)
+	for i := range jobs {
+		if jobs[i].cron != nil {
+			jobs[i].cron.Stop()
+		}
+	}
+	threads := localThreads(w)
 	for i := range threads {
-		threads[i].stop(w)
+		threads[i].drain(w)
 	}
+	w.wakeUp()
 }
 
+//Drain Shuts the worker down, giving threads, jobs and endpoint requests up to
+//timeout to finish.  Threads still running after that are handed back as is.
+func (w *worker) Drain(timeout time.Duration) {
+	w.Shutdown()
+	deadline := time.Now().Add(timeout)
+	heartbeating := make(chan struct{})
+	go keepHeartbeat(w, heartbeating)
+
+	finished := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		log.Warn("Drain timed out, handing back remaining work")
+		threads := localThreads(w)
+		for i := range threads {
+			threads[i].forceStop(w)
+		}
+		jobs := localJobs(w)
+		for i := range jobs {
+			jobs[i].abandon(w)
+		}
+	}
+
+	if w.endpointServer != nil {
+		shutdownServer(w.endpointServer, deadline)
+	}
+	close(heartbeating)
+	Resign(w)
+	publishEvent(w, WORKERLEFT, workerKey(w))
+	w.Client.HSet(ctx, workerKey(w), "State", OFFLINE)
+	if w.apiServer != nil {
+		shutdownServer(w.apiServer, deadline)
+	}
+	if w.healthServer != nil {
+		shutdownServer(w.healthServer, deadline)
+	}
+}
+
+// keepHeartbeat heartbeats until done is closed, so the leader doesn't take
+// back work a draining worker is still finishing however long the drain takes.
+func keepHeartbeat(w *worker, done chan struct{}) {
+	ticker := time.NewTicker(getClusterDuration(w, "WorkerTimeout", defaultWorkerTimeout) / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			Heartbeat(w)
+		}
+	}
+}
+
+func shutdownServer(server *http.Server, deadline time.Time) {
+	//Always give in flight requests a moment even if the drain ran over.
+	if time.Until(deadline) < time.Second {
+		deadline = time.Now().Add(time.Second)
+	}
+	shutdownCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Warn("Error shutting down server ", server.Addr)
+	}
+}
+
+// track counts a thread, job run or endpoint request so a drain can wait for
+// it.  Returns false once the worker is draining.
+func (w *worker) track() bool {
+	w.drainMutex.Lock()
+	defer w.drainMutex.Unlock()
+	if w.shuttingDown {
+		return false
+	}
+	w.running.Add(1)
+	return true
+}
+
+func (w *worker) isShuttingDown() bool {
+	w.drainMutex.Lock()
+	defer w.drainMutex.Unlock()
+	return w.shuttingDown
+}
+
+func workerKey(w *worker) string {
+	return w.Cluster + ":workers:" + w.WorkerName
+}
+
+// getThreads returns an entry for every instance of every thread, adding new
+// threads and replicas and dropping replicas that were scaled away.
 func getThreads(w *worker) map[string]*ThreadMeta {
-	keys := w.Client.Keys(ctx, w.Cluster+":Threads:*").Val()
+	keys := getTaskKeys(w, THREADS)
+	replicas := make(map[string]int, len(keys))
+	for i := range keys {
+		replicas[keys[i]] = getReplicas(w, keys[i])
+	}
+
+	w.threadsMutex.Lock()
+	defer w.threadsMutex.Unlock()
 	if w.threads == nil {
 		w.threads = make(map[string]*ThreadMeta, 0)
 	}
 
-	for i := range keys {
-		if w.threads[keys[i]] == nil {
-			w.threads[keys[i]] = &ThreadMeta{Key: keys[i], Stopped: true}
+	for key, count := range replicas {
+		for instance := 0; instance < count; instance++ {
+			iKey := instanceKey(key, instance)
+			if w.threads[iKey] == nil {
+				w.threads[iKey] = &ThreadMeta{Key: iKey, Definition: key, Instance: instance, Stopped: true}
+			}
 		}
 	}
-	return w.threads
+	for iKey, tm := range w.threads {
+		//Running instances notice they were scaled away themselves.
+		if count, ok := replicas[tm.definition()]; ok && tm.Instance >= count && tm.isStopped() {
+			delete(w.threads, iKey)
+		}
+	}
+	return copyThreads(w.threads)
+}
+
+// localInstances returns the instances of a thread this worker knows about.
+func localInstances(w *worker, key string) []*ThreadMeta {
+	instances := make([]*ThreadMeta, 0)
+	threads := localThreads(w)
+	for i := range threads {
+		if threads[i].definition() == key {
+			instances = append(instances, threads[i])
+		}
+	}
+	return instances
+}
+
+// runsInstance reports if this worker is running an instance of a thread.
+func runsInstance(w *worker, key string) bool {
+	instances := localInstances(w, key)
+	for i := range instances {
+		if !instances[i].isStopped() {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetThread drops a thread whose key no longer exists.
+func forgetThread(w *worker, key string) {
+	unregisterTask(w, THREADS, key)
+	w.threadsMutex.Lock()
+	defer w.threadsMutex.Unlock()
+	delete(w.threads, key)
+}
+
+// localThreads returns the threads this worker knows about without asking redis.
+func localThreads(w *worker) map[string]*ThreadMeta {
+	w.threadsMutex.Lock()
+	defer w.threadsMutex.Unlock()
+	return copyThreads(w.threads)
+}
+
+func copyThreads(threads map[string]*ThreadMeta) map[string]*ThreadMeta {
+	out := make(map[string]*ThreadMeta, len(threads))
+	for key, tm := range threads {
+		out[key] = tm
+	}
+	return out
 }
 
 func getJobs(w *worker) map[string]*JobMeta {
-	keys := w.Client.Keys(ctx, w.Cluster+":Jobs:*").Val()
+	keys := getTaskKeys(w, JOBS)
+	w.jobsMutex.Lock()
+	defer w.jobsMutex.Unlock()
 	if w.jobs == nil {
 		w.jobs = make(map[string]*JobMeta, 0)
 	}
@@ -189,49 +506,66 @@ func getJobs(w *worker) map[string]*JobMeta {
 			w.jobs[keys[i]] = &JobMeta{Key: keys[i], Stopped: true}
 		}
 	}
-	return w.jobs
+	return copyJobs(w.jobs)
+}
+
+// localJobs returns the jobs this worker knows about without asking redis.
+func localJobs(w *worker) map[string]*JobMeta {
+	w.jobsMutex.Lock()
+	defer w.jobsMutex.Unlock()
+	return copyJobs(w.jobs)
+}
+
+func copyJobs(jobs map[string]*JobMeta) map[string]*JobMeta {
+	out := make(map[string]*JobMeta, len(jobs))
+	for key, jm := range jobs {
+		out[key] = jm
+	}
+	return out
 }
 
 //IsEnabled Returns if the worker is enabled.
 func IsEnabled(w *worker) bool {
 	status := w.Client.HGet(ctx, w.Cluster+":workers:"+w.WorkerName, "Status").Val()
-	if w.shuttingDown || status == DISABLED {
+	if w.isShuttingDown() || status == DISABLED {
 		return false
 	}
 	return true
 }
 
-//CheckThreads Checks threads in redis for any that need ran.
+//CheckThreads Checks threads in redis for any that need ran.  A thread is only
+//taken if it fits under the worker's capacity and no live worker that could
+//run it is less loaded.
 func CheckThreads(w *worker) {
 	threads := getThreads(w)
+	peers := liveWorkers(w)
+	load, _ := localLoad(w)
 	for i := range threads {
-		threadStatus := threads[i].getStatus(w)
-		threadState := threads[i].getState(w)
-		if threadStatus != DISABLED {
-			if threadState == STOPPED {
-				threads[i].take(w)
-				continue
-			}
-			//Check to see if thread is hung or fell over before its state was updated
-			lastHeartbeat, err := threads[i].getHeartBeat(w)
-
-			if err == nil {
-				deadSeconds, err := threads[i].getDeadSeconds(w)
-				if err == nil {
-					if deadSeconds == 0 {
-						deadSeconds = w.SecondsTillDead
-					}
-					elapsed := time.Since(time.Unix(0, int64(lastHeartbeat)))
-					if int(elapsed.Seconds()) > deadSeconds && lastHeartbeat != 0 {
-						threads[i].take(w)
-					}
-				} else {
-					log.WithError(err).Error("Error getting dead seconds")
-				}
-			} else {
-				log.WithError(err).Error("Error checking thread hang")
-			}
+		//Threads we are already running renew their own lease.
+		if !threads[i].isStopped() {
+			continue
+		}
+		p := getPlacement(w, threads[i].definition())
+		if !canPlace(w, p, peers) || !hasRoom(load, p.Weight, w.MaxThreads) {
+			continue
 		}
+		//Partitioned threads run one instance per worker, the rest are spread
+		//by load.
+		if p.Partitioned && runsInstance(w, threads[i].definition()) {
+			continue
+		}
+		if !p.Partitioned && !leastLoaded(w, load, p, peers) {
+			continue
+		}
+		if threads[i].take(w) {
+			load += p.Weight
+			publishLoad(w)
+		}
+	}
+
+	if time.Since(w.lastRebalance) >= getClusterDuration(w, "RebalanceInterval", defaultRebalanceInterval) {
+		w.lastRebalance = time.Now()
+		rebalanceThreads(w, peers)
 	}
 }
 
@@ -241,13 +575,28 @@ func CheckJobs(w *worker) {
 	for i := range jobs {
 		jobStatus := jobs[i].getStatus(w)
 		jobState := jobs[i].getState(w)
-		if jobStatus != DISABLED {
-			if jobState == STOPPED {
-				jobs[i].schedule(w)
-				continue
-			}
+		if jobState == "" && w.Client.Exists(ctx, jobs[i].Key).Val() == 0 {
+			forgetJob(w, jobs[i])
+			continue
 		}
+		//Every worker schedules every enabled job, the ticks are claimed when
+		//they fire so each one runs once.
+		if jobStatus == DISABLED || jobs[i].getCron(w) == "" {
+			jobs[i].unschedule()
+			continue
+		}
+		jobs[i].schedule(w)
 	}
+	checkScheduled(w)
+}
+
+// forgetJob unschedules and drops a job whose key no longer exists.
+func forgetJob(w *worker, jm *JobMeta) {
+	unregisterTask(w, JOBS, jm.Key)
+	jm.unschedule()
+	w.jobsMutex.Lock()
+	defer w.jobsMutex.Unlock()
+	delete(w.jobs, jm.Key)
 }
 
 func loadScripts(w *worker, scripts string) error {
@@ -260,7 +609,7 @@ func loadScripts(w *worker, scripts string) error {
 			return err
 		}
 		key := w.Cluster + ":Threads:" + scriptName
-		w.Client.HSet(ctx, key, "Source", string(fBytes))
+		existed := w.Client.Exists(ctx, key).Val() == 1
 		w.Client.HSet(ctx, key, "Status", ENABLED)
 		w.Client.HSet(ctx, key, "State", STOPPED)
 		w.Client.HSet(ctx, key, "Heartbeat", 0)
@@ -269,16 +618,34 @@ func loadScripts(w *worker, scripts string) error {
 		w.Client.HSet(ctx, key, "Owner", "")
 		w.Client.HSet(ctx, key, "Error", "")
 		w.Client.HSet(ctx, key, "ErrorTime", "")
+		if _, err := saveSource(w, key, string(fBytes), w.WorkerName, "Loaded from "+scriptName); err != nil {
+			return err
+		}
+		if !existed {
+			publishEvent(w, THREADCREATED, key)
+		}
 	}
 
 	return nil
 }
 
 func (w *worker) handleEndpoint(writer http.ResponseWriter, r *http.Request) {
-	if w.Healthy {
+	//Requests are counted so a drain waits for them, new ones are turned away.
+	if !w.track() {
+		http.Error(writer, "Worker is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer w.running.Done()
+	if w.isHealthy() {
 		em := getEndpoint(w, html.EscapeString(r.URL.Path))
 		if em != nil {
-			em.run(w, writer, r)
+			recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+			start := time.Now()
+			em.run(w, recorder, r)
+			w.metrics.add("hats_endpoint_requests_total", "Requests served by endpoints.", 1,
+				"task", em.Key, "status", strconv.Itoa(recorder.status))
+			w.metrics.observe("hats_endpoint_duration_seconds", "Time taken to serve endpoint requests.",
+				time.Since(start), "task", em.Key)
 		} else {
 			http.Error(writer, "Endpoint not found", http.StatusNotFound)
 		}
@@ -286,6 +653,14 @@ func (w *worker) handleEndpoint(writer http.ResponseWriter, r *http.Request) {
 }
 
 func applyLibrary(w *worker, tm TaskInterface) {
+	var output *runOutput
+	if jm, ok := tm.(*JobMeta); ok {
+		output = jm.output
+	}
+	tm.getVM().Set("console", newConsole(w, tm.getKey(), output))
+	tm.getVM().Set("log", newLogger(w, tm.getKey()))
+	tm.getVM().Set("metrics", newScriptMetrics(w, tm.getKey()))
+
 	tm.getVM().Set("redis", map[string]interface{}{
 		"Do2": w.Client.Do,
 		"Do": func(call otto.FunctionCall) otto.Value {
@@ -314,6 +689,8 @@ func applyLibrary(w *worker, tm TaskInterface) {
 		},
 	})
 
+	tm.getVM().Set("jobs", newJobs(w))
+
 	tm.getVM().Set("http", map[string]interface{}{
 		"Get":      httpGet,
 		"Post":     httpPost,
@@ -329,7 +706,8 @@ func applyLibrary(w *worker, tm TaskInterface) {
 	tm.getVM().Set("worker", map[string]interface{}{
 		"Name":         w.WorkerName,
 		"Cluster":      w.Cluster,
-		"ShuttingDown": w.Shutdown,
+		"ShuttingDown": func() bool { return w.isShuttingDown() },
+		"IsLeader":     func() bool { return w.isLeader() },
 	})
 
 	tm.getVM().Set("env", map[string]interface{}{
@@ -382,6 +760,8 @@ func applyLibrary(w *worker, tm TaskInterface) {
 		t := tm.(*JobMeta)
 		t.vm.Set("job", map[string]interface{}{
 			"Key":     t.Key,
+			"Run":     t.RunID,
+			"Params":  t.params,
 			"Stopped": t.Stopped,
 			"State": func() otto.Value {
 				value, _ := t.vm.ToValue(t.getState(w))
@@ -398,14 +778,17 @@ func applyLibrary(w *worker, tm TaskInterface) {
 	case *ThreadMeta:
 		t := tm.(*ThreadMeta)
 		tm.getVM().Set("thread", map[string]interface{}{
-			"Key":     t.Key,
-			"Stopped": t.Stopped,
+			"Key":        t.Key,
+			"Definition": t.definition(),
+			"Instance":   t.Instance,
+			"Replicas":   t.replicas,
+			"Stopped":    t.isStopped(),
 			"State": func() otto.Value {
-				value, _ := t.vm.ToValue(t.getState(w))
+				value, _ := t.getVM().ToValue(t.getState(w))
 				return value
 			},
 			"Status": func() otto.Value {
-				value, _ := t.vm.ToValue(t.getStatus(w))
+				value, _ := t.getVM().ToValue(t.getStatus(w))
 				return value
 			},
 			"Disable": func() {
@@ -414,11 +797,92 @@ func applyLibrary(w *worker, tm TaskInterface) {
 			"Stop": func() {
 				t.stop(w)
 			},
+			"Partitions": func() otto.Value {
+				value, _ := t.getVM().ToValue(t.getPartitions())
+				return value
+			},
+		})
+	}
+
+}
+
+// errInterrupted is raised inside a VM to halt whatever it is running.
+var errInterrupted = errors.New("script interrupted")
+
+// errTimeout is raised inside a VM that ran longer than it was allowed to.
+var errTimeout = errors.New("script timed out")
+
+// runScript runs source in vm, returning errInterrupted if the run was halted
+// through interruptVM or errTimeout if it ran longer than timeout.  A timeout of
+// 0 lets the script run as long as it likes.
+func runScript(vm *otto.Otto, source string, timeout time.Duration) (value otto.Value, err error) {
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught == errInterrupted || caught == errTimeout {
+				err = caught.(error)
+				return
+			}
+			panic(caught)
+		}
+	}()
+
+	if timeout > 0 {
+		//Guards against the timer firing after the run finished but before it was stopped.
+		var finished int32
+		timer := time.AfterFunc(timeout, func() {
+			halt := func() {
+				if atomic.LoadInt32(&finished) == 0 {
+					panic(errTimeout)
+				}
+			}
+			select {
+			case vm.Interrupt <- halt:
+			default:
+			}
 		})
+		defer func() {
+			atomic.StoreInt32(&finished, 1)
+			timer.Stop()
+		}()
 	}
+	return vm.Run(source)
+}
 
+// interruptVM halts the script currently running in vm without blocking.  Any
+// interrupt already pending is replaced.
+func interruptVM(vm *otto.Otto) {
+	if vm == nil || vm.Interrupt == nil {
+		return
+	}
+	halt := func() { panic(errInterrupted) }
+	for {
+		select {
+		case vm.Interrupt <- halt:
+			return
+		default:
+		}
+		//A stale timeout from an earlier run is in the way, the halt replaces it.
+		select {
+		case <-vm.Interrupt:
+		default:
+		}
+	}
+}
+
+// drainInterrupts discards interrupts that arrived while vm was idle.
+func drainInterrupts(vm *otto.Otto) {
+	for {
+		select {
+		case <-vm.Interrupt:
+		default:
+			return
+		}
+	}
 }
 
+// cronParser reads crons with seconds.
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.DowOptional | cron.Descriptor)
+
 func newWithSeconds() *cron.Cron {
-	return cron.New(cron.WithParser(cron.NewParser(cron.Second|cron.Minute|cron.Hour|cron.Dom|cron.Month|cron.DowOptional|cron.Descriptor)), cron.WithChain())
+	return cron.New(cron.WithParser(cronParser), cron.WithChain())
 }
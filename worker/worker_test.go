@@ -1,22 +1,37 @@
 package worker
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/server"
 	"github.com/go-redis/redis/v8"
+	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
+	log "github.com/sirupsen/logrus"
 )
 
 func TestStartErrorWithNoRedisAddress(t *testing.T) {
-	_, err := Create("", "", "", "TestCluster", "Testworker", "", false, "9999", "8787")
+	_, err := Create(Options{Cluster: "TestCluster", WorkerName: "Testworker", HostPort: "9999", HealthPort: "8787", CPUThreshold: 1, MemThreshold: 90, HealthInterval: time.Second})
 	if err.Error() != "no redis address provided" {
 		t.Errorf("Did not fail due to no redis address.")
 	}
 }
 
 func TestStartErrorWithFailedPing(t *testing.T) {
-	_, err := Create("", "bad", "", "TestCluster", "Testworker", "", false, "9999", "8787")
+	_, err := Create(Options{RedisAddr: "bad", Cluster: "TestCluster", WorkerName: "Testworker", HostPort: "9999", HealthPort: "8787", CPUThreshold: 1, MemThreshold: 90, HealthInterval: time.Second})
 	if err.Error() != "redis failed ping" {
 		t.Errorf("Did not fail due to failed ping.")
 	}
@@ -24,7 +39,7 @@ func TestStartErrorWithFailedPing(t *testing.T) {
 
 func TestStartReturnsNilWhenSuccessful(t *testing.T) {
 	mr, _ := miniredis.Run()
-	_, err := Create("", mr.Addr(), "", "TestCluster", "Testworker", "", false, "9999", "8787")
+	_, err := Create(Options{RedisAddr: mr.Addr(), Cluster: "TestCluster", WorkerName: "Testworker", HostPort: "9999", HealthPort: "8787", CPUThreshold: 1, MemThreshold: 90, HealthInterval: time.Second})
 	if err != nil {
 		t.Errorf("Errored starting worker.")
 	}
@@ -32,8 +47,8 @@ func TestStartReturnsNilWhenSuccessful(t *testing.T) {
 
 func TestStartHandlesScriptsPassedIn(t *testing.T) {
 	mr, _ := miniredis.Run()
-	scripts := "../examples/hello.txt"
-	_, err := Create("", mr.Addr(), "", "TestCluster", "Testworker", scripts, false, "9999", "8787")
+	scripts := "../examples/hello.js"
+	_, err := Create(Options{RedisAddr: mr.Addr(), Cluster: "TestCluster", WorkerName: "Testworker", ScriptList: scripts, HostPort: "9999", HealthPort: "8787", CPUThreshold: 1, MemThreshold: 90, HealthInterval: time.Second})
 	if err != nil {
 		t.Errorf("Errored getting scripts")
 	}
@@ -42,7 +57,7 @@ func TestStartHandlesScriptsPassedIn(t *testing.T) {
 func TestStartErrorsIfItCanNotFindScript(t *testing.T) {
 	mr, _ := miniredis.Run()
 	scripts := "../examples/doesnotexist.txt"
-	_, err := Create("", mr.Addr(), "", "TestCluster", "Testworker", scripts, false, "9999", "8787")
+	_, err := Create(Options{RedisAddr: mr.Addr(), Cluster: "TestCluster", WorkerName: "Testworker", ScriptList: scripts, HostPort: "9999", HealthPort: "8787", CPUThreshold: 1, MemThreshold: 90, HealthInterval: time.Second})
 	if err == nil {
 		t.Errorf("Did not error getting scripts.")
 	}
@@ -57,7 +72,7 @@ func TestLoadScripts(t *testing.T) {
 
 	w := &worker{RedisAddr: mr.Addr(), Client: client}
 
-	err := loadScripts(w, "../examples/hello.txt")
+	err := loadScripts(w, "../examples/hello.js")
 	if err != nil {
 		t.Errorf("Failed to load script.")
 	}
@@ -76,3 +91,805 @@ func TestLoadScriptsDoesNotExist(t *testing.T) {
 		t.Errorf("Did not return error when script failed to load.")
 	}
 }
+
+func TestReadMemoryUsage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "health")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "meminfo")
+	ioutil.WriteFile(path, []byte("MemTotal:        1000 kB\nMemFree:          100 kB\nMemAvailable:     250 kB\n"), 0644)
+
+	usage, err := readMemoryUsage(path)
+	if err != nil {
+		t.Fatalf("Failed to read memory usage: %v", err)
+	}
+	if usage != 75 {
+		t.Errorf("Expected 75%% memory usage, got %v", usage)
+	}
+}
+
+func TestReadLoadAverageMissingFile(t *testing.T) {
+	_, err := readLoadAverage("/does/not/exist")
+	if err == nil {
+		t.Errorf("Did not error reading missing load average.")
+	}
+}
+
+func TestEvaluateHealthRecoversWithHysteresis(t *testing.T) {
+	healthy, reason := evaluateHealth(true, 1.5, 50, 1, 90)
+	if healthy || reason == "" {
+		t.Fatalf("Worker over its load threshold was not critical.")
+	}
+
+	healthy, _ = evaluateHealth(false, 0.95, 50, 1, 90)
+	if healthy {
+		t.Errorf("Critical worker recovered before dropping under the recovery margin.")
+	}
+
+	healthy, _ = evaluateHealth(false, 0.5, 50, 1, 90)
+	if !healthy {
+		t.Errorf("Critical worker did not recover under its thresholds.")
+	}
+}
+
+func TestLoadScriptsRegistersThreads(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+
+	loadScripts(w, "../examples/hello.js")
+	if ok, _ := mr.IsMember("TestCluster:Index:Threads", "TestCluster:Threads:../examples/hello.js"); !ok {
+		t.Errorf("Loaded thread was not registered in the index.")
+	}
+}
+
+func TestGetThreadsMigratesUnindexedKeys(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	addTestThread(mr, "TestCluster:Threads:legacy", STOPPED)
+	mr.HSet("TestCluster:Threads:legacy:Errors", "Source", "")
+	mr.HSet("TestCluster:Jobs:job", "Source", "")
+
+	threads := getThreads(w)
+	if len(threads) != 1 || threads["TestCluster:Threads:legacy"] == nil {
+		t.Errorf("Expected only the legacy thread, got %v", threads)
+	}
+}
+
+func TestCheckThreadsForgetsDeletedThreads(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	registerTask(w, THREADS, "TestCluster:Threads:gone")
+
+	CheckThreads(w)
+	if ok, _ := mr.IsMember("TestCluster:Index:Threads", "TestCluster:Threads:gone"); ok {
+		t.Errorf("Deleted thread was left in the index.")
+	}
+	if len(localThreads(w)) != 0 {
+		t.Errorf("Deleted thread was left in the worker.")
+	}
+}
+
+func TestClusterEventWakesWorker(t *testing.T) {
+	w := &worker{wake: make(chan struct{}, 1)}
+	w.handleEvent(event{Type: THREADCREATED, Key: "TestCluster:Threads:new"})
+
+	start := time.Now()
+	w.WaitForWork(time.Minute)
+	if time.Since(start) > time.Second {
+		t.Errorf("Worker waited for its interval after a cluster event.")
+	}
+}
+
+func TestEventListenerRetriesUntilShutdown(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+
+	//miniredis has no pub/sub so every subscription fails.
+	done := make(chan struct{})
+	go func() {
+		w.listenForEvents()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Listener gave up after a failed subscription.")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	w.drainMutex.Lock()
+	w.shuttingDown = true
+	w.drainMutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("Listener kept retrying after the worker shut down.")
+	}
+}
+
+func TestSaveSourceKeepsVersions(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Jobs:versioned"
+
+	first, _ := saveSource(w, key, "console.log('one')", "tester", "first")
+	second, _ := saveSource(w, key, "console.log('two')", "tester", "second")
+	if first == second {
+		t.Fatalf("Different sources got the same version.")
+	}
+	if len(getVersions(w, key)) != 2 {
+		t.Errorf("Expected 2 versions, got %d", len(getVersions(w, key)))
+	}
+
+	if err := rollback(w, key, first); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	source, version := getActiveSource(w, key)
+	if version != first || source != "console.log('one')" {
+		t.Errorf("Rollback did not activate the first version.")
+	}
+	if err := rollback(w, key, "missing"); err == nil {
+		t.Errorf("Rolled back to a version that does not exist.")
+	}
+}
+
+func TestSourceEditedInRedisBecomesAVersion(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Jobs:edited"
+
+	first, _ := saveSource(w, key, "console.log('one')", "tester", "first")
+	mr.HSet(key, "Source", "console.log('edited')")
+
+	source, version := getActiveSource(w, key)
+	if source != "console.log('edited')" || version != sourceVersion(source) {
+		t.Fatalf("Edited source was not served, got %s", source)
+	}
+	if mr.HGet(key, "SourceVersion") != version || mr.HGet(key, "PreviousVersion") != first {
+		t.Errorf("Edited source was not made the active version.")
+	}
+	if len(getVersions(w, key)) != 2 {
+		t.Errorf("Expected the edit to be saved as a version, got %d versions", len(getVersions(w, key)))
+	}
+	if err := rollback(w, key, first); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if source, _ := getActiveSource(w, key); source != "console.log('one')" {
+		t.Errorf("Could not roll back the edit, got %s", source)
+	}
+}
+
+func TestWritesOnlyOnTheAPIPort(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Jobs:guarded"
+	health := http.NewServeMux()
+	registerReadAPI(w, health)
+	api := newAPIHandler(w, "secret")
+
+	res := httptest.NewRecorder()
+	health.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/versions?key="+key, strings.NewReader("1")))
+	if res.Code != http.StatusMethodNotAllowed || mr.Exists(key) {
+		t.Errorf("Health port saved a version, status %d", res.Code)
+	}
+	res = httptest.NewRecorder()
+	health.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/rollback?key="+key+"&version=v1", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Health port serves rollbacks, status %d", res.Code)
+	}
+	job := "TestCluster:Jobs:queued"
+	mr.HSet(job, "Source", "redis.Do('incr', 'queued')")
+	for _, path := range []string{"/trigger?key=" + job, "/once?key=TestCluster:Jobs:once"} {
+		res = httptest.NewRecorder()
+		health.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path, strings.NewReader("1")))
+		if res.Code != http.StatusNotFound {
+			t.Errorf("Health port serves %s, status %d", path, res.Code)
+		}
+	}
+	if mr.Exists("TestCluster:Scheduled") || mr.Exists("TestCluster:Jobs:once") {
+		t.Errorf("Health port queued a run.")
+	}
+	res = httptest.NewRecorder()
+	health.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/versions?key="+key, nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Health port stopped listing versions, status %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	api.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/versions?key="+key, strings.NewReader("1")))
+	if res.Code != http.StatusUnauthorized || mr.Exists(key) {
+		t.Errorf("API saved a version without the token, status %d", res.Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/versions?key="+key, strings.NewReader("1"))
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	api.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || len(getVersions(w, key)) != 1 {
+		t.Errorf("API did not save the version, status %d", res.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/trigger?key="+job, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	api.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || !mr.Exists("TestCluster:Scheduled") {
+		t.Errorf("API did not trigger the job, status %d", res.Code)
+	}
+}
+
+func TestAutoRollbackWithinWindow(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Threads:rollback"
+
+	good, _ := saveSource(w, key, "function main() {}", "tester", "good")
+	bad, _ := saveSource(w, key, "function main() { throw 'bad' }", "tester", "bad")
+	if autoRollback(w, key) {
+		t.Fatalf("Rolled back without a rollback window.")
+	}
+
+	mr.HSet("TestCluster:Settings", "RollbackWindow", "1m")
+	if !autoRollback(w, key) {
+		t.Fatalf("Did not roll back a version that failed inside the window.")
+	}
+	if mr.HGet(key, "SourceVersion") != good || mr.HGet(key, "RolledBackFrom") != bad {
+		t.Errorf("Rollback did not restore the good version.")
+	}
+	if autoRollback(w, key) {
+		t.Errorf("Rolled back twice.")
+	}
+}
+
+func TestRecordErrorKeepsCappedHistory(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Threads:flapping"
+	mr.HSet(key, "ErrorHistory", "3")
+
+	vm := otto.New()
+	_, scriptErr := vm.Run("function main() { throw new Error('broken') }\nmain()")
+	for i := 0; i < 5; i++ {
+		recordError(w, key, PHASEMAIN, "v1", scriptErr)
+	}
+
+	errs := getErrors(w, key, 10)
+	if len(errs) != 3 {
+		t.Fatalf("Expected error log capped at 3, got %d", len(errs))
+	}
+	if errs[0].Phase != PHASEMAIN || errs[0].Worker != "worker" || errs[0].Version != "v1" {
+		t.Errorf("Error entry missing context: %+v", errs[0])
+	}
+	if errs[0].Stack == "" {
+		t.Errorf("Error entry is missing the stack trace.")
+	}
+	if mr.HGet(key, "Error") == "" {
+		t.Errorf("Latest error was not kept on the task.")
+	}
+}
+
+func TestRunScriptTimesOut(t *testing.T) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+
+	_, err := runScript(vm, "while (true) {}", 50*time.Millisecond)
+	if err != errTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	//A finished run must not be interrupted by its timer afterwards.
+	if _, err := runScript(vm, "1 + 1", time.Second); err != nil {
+		t.Errorf("Script after a timeout failed: %v", err)
+	}
+}
+
+func TestInterruptReplacesStaleTimeout(t *testing.T) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	//A timeout that fired after its run had already finished.
+	vm.Interrupt <- func() {}
+
+	interruptVM(vm)
+	if _, err := runScript(vm, "while (true) {}", 0); err != errInterrupted {
+		t.Errorf("Expected the script to be interrupted, got %v", err)
+	}
+}
+
+func TestEndpointTimeoutReturnsGatewayTimeout(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Endpoints:/slow"
+	mr.HSet(key, "Source", "<? while (true) {} ?>")
+	mr.HSet(key, "Timeout", "50ms")
+
+	recorder := httptest.NewRecorder()
+	w.handleEndpoint(recorder, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504, got %d", recorder.Code)
+	}
+	if errs := getErrors(w, key, 1); len(errs) != 1 || errs[0].Type != TIMEOUT {
+		t.Errorf("Timeout was not recorded as a timeout.")
+	}
+}
+
+func TestDrainWaitsForEndpointRequests(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Endpoints:/slow"
+	mr.HSet(key, "Source", "<? var until = Date.now() + 300; while (Date.now() < until) {} ?>done")
+
+	served := make(chan int, 1)
+	go func() {
+		recorder := httptest.NewRecorder()
+		w.handleEndpoint(recorder, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		served <- recorder.Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	drained := make(chan struct{})
+	go func() {
+		w.Drain(2 * time.Second)
+		close(drained)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	w.handleEndpoint(recorder, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Draining worker took a new request, status %d", recorder.Code)
+	}
+
+	select {
+	case <-drained:
+		t.Errorf("Drain finished before the request in flight.")
+	case code := <-served:
+		if code != http.StatusOK {
+			t.Errorf("Request in flight failed with %d", code)
+		}
+	}
+	<-drained
+}
+
+func TestFormatConsole(t *testing.T) {
+	vm := otto.New()
+	a, _ := vm.ToValue("count")
+	b, _ := vm.ToValue(3)
+	if message := formatConsole([]otto.Value{a, b}); message != "count 3" {
+		t.Errorf("Expected \"count 3\", got %q", message)
+	}
+}
+
+// streamServer stands in for the redis stream commands miniredis doesn't have.
+// It keeps each stream whole and records the MAXLEN it was asked to keep.
+type streamServer struct {
+	*server.Server
+	mutex   sync.Mutex
+	streams map[string][][]string
+	maxLen  map[string]string
+	lastID  int
+	//Called after each XREVRANGE is answered.
+	afterRange func()
+}
+
+func newStreamServer(t *testing.T) *streamServer {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting stream server: %v", err)
+	}
+	s := &streamServer{Server: srv, streams: make(map[string][][]string), maxLen: make(map[string]string)}
+	srv.Register("XADD", s.xadd)
+	srv.Register("XREVRANGE", s.xrevrange)
+	srv.Register("XREAD", s.xread)
+	return s
+}
+
+func (s *streamServer) worker() *worker {
+	client := redis.NewClient(&redis.Options{Addr: s.Addr().String()})
+	return &worker{Client: client, Cluster: "TestCluster", WorkerName: "worker", metrics: newMetricsRegistry()}
+}
+
+// xadd handles XADD key MAXLEN ~ n * field value ...
+func (s *streamServer) xadd(c *server.Peer, cmd string, args []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := args[0]
+	if strings.ToUpper(args[1]) == "MAXLEN" {
+		s.maxLen[key] = args[2] + " " + args[3]
+		args = args[4:]
+	} else {
+		args = args[1:]
+	}
+	s.lastID++
+	id := strconv.Itoa(s.lastID) + "-0"
+	s.streams[key] = append(s.streams[key], append([]string{id}, args[1:]...))
+	c.WriteBulk(id)
+}
+
+// xrevrange handles XREVRANGE key + - COUNT n
+func (s *streamServer) xrevrange(c *server.Peer, cmd string, args []string) {
+	s.mutex.Lock()
+	count, _ := strconv.Atoi(args[4])
+	entries := s.streams[args[0]]
+	if count > len(entries) {
+		count = len(entries)
+	}
+	c.WriteLen(count)
+	for i := 0; i < count; i++ {
+		writeStreamEntry(c, entries[len(entries)-1-i])
+	}
+	after := s.afterRange
+	s.afterRange = nil
+	s.mutex.Unlock()
+	if after != nil {
+		after()
+	}
+}
+
+// xread handles XREAD BLOCK ms STREAMS key id
+func (s *streamServer) xread(c *server.Peer, cmd string, args []string) {
+	block, _ := strconv.Atoi(args[1])
+	key, lastID := args[3], args[4]
+	s.mutex.Lock()
+	after := s.lastID
+	s.mutex.Unlock()
+	if lastID != "$" {
+		after, _ = strconv.Atoi(strings.TrimSuffix(lastID, "-0"))
+	}
+	deadline := time.Now().Add(time.Duration(block) * time.Millisecond)
+	for {
+		s.mutex.Lock()
+		newer := make([][]string, 0)
+		for _, entry := range s.streams[key] {
+			if id, _ := strconv.Atoi(strings.TrimSuffix(entry[0], "-0")); id > after {
+				newer = append(newer, entry)
+			}
+		}
+		s.mutex.Unlock()
+		if len(newer) > 0 {
+			c.WriteLen(1)
+			c.WriteLen(2)
+			c.WriteBulk(key)
+			c.WriteLen(len(newer))
+			for i := range newer {
+				writeStreamEntry(c, newer[i])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			c.WriteNull()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeStreamEntry(c *server.Peer, entry []string) {
+	c.WriteLen(2)
+	c.WriteBulk(entry[0])
+	c.WriteLen(len(entry) - 1)
+	for _, value := range entry[1:] {
+		c.WriteBulk(value)
+	}
+}
+
+func TestLogStreamIsCappedAndRead(t *testing.T) {
+	s := newStreamServer(t)
+	defer s.Close()
+	w := s.worker()
+	key := "TestCluster:Threads:logged"
+
+	appendLog(w, key, log.InfoLevel, "one", nil, 2)
+	appendLog(w, key, log.WarnLevel, "two", log.Fields{"queue": "a"}, 2)
+	appendLog(w, key, log.ErrorLevel, "three", nil, 2)
+	s.mutex.Lock()
+	maxLen := s.maxLen[logStreamKey(key)]
+	s.mutex.Unlock()
+	if maxLen != "~ 2" {
+		t.Errorf("Log stream was not capped, MAXLEN %q", maxLen)
+	}
+
+	entries, err := getLogs(w, key, 2)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected the latest 2 lines, got %v %v", entries, err)
+	}
+	if entries[0].Message != "two" || entries[1].Message != "three" {
+		t.Errorf("Lines not oldest first: %+v", entries)
+	}
+	if entries[0].Level != "warning" || entries[0].Worker != "worker" || entries[0].Fields["queue"] != "a" || entries[0].Time == 0 {
+		t.Errorf("Line not read back whole: %+v", entries[0])
+	}
+}
+
+func TestTailLogsWaitsForNewLines(t *testing.T) {
+	s := newStreamServer(t)
+	defer s.Close()
+	w := s.worker()
+	key := "TestCluster:Threads:tailed"
+	appendLog(w, key, log.InfoLevel, "one", nil, 10)
+	earlier, _ := getLogs(w, key, 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		appendLog(w, key, log.InfoLevel, "two", nil, 10)
+	}()
+	entries, err := tailLogs(w, key, "$", 2*time.Second)
+	if err != nil || len(entries) != 1 || entries[0].Message != "two" {
+		t.Fatalf("Expected the new line, got %v %v", entries, err)
+	}
+	entries, _ = tailLogs(w, key, earlier[0].ID, time.Second)
+	if len(entries) != 1 || entries[0].Message != "two" {
+		t.Errorf("Expected the line after %s, got %v", earlier[0].ID, entries)
+	}
+	if entries, err := tailLogs(w, key, entries[0].ID, 50*time.Millisecond); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no lines after waiting, got %v %v", entries, err)
+	}
+}
+
+func TestFollowingLogsMissesNoLines(t *testing.T) {
+	s := newStreamServer(t)
+	w := s.worker()
+	key := "TestCluster:Threads:followed"
+	//A line lands between reading the latest lines and following the stream.
+	s.afterRange = func() {
+		appendLog(w, key, log.InfoLevel, "between", nil, 10)
+	}
+	api := httptest.NewServer(http.HandlerFunc(w.handleLogs))
+
+	res, err := http.Get(api.URL + "/logs?key=" + key + "&follow=true")
+	if err != nil {
+		t.Fatalf("Error following logs: %v", err)
+	}
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		var entry logEntry
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.Message != "between" {
+			t.Errorf("Expected the line written before following, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Line written before following was lost.")
+	}
+	res.Body.Close()
+	//Wake the follower so it notices the client went.
+	appendLog(w, key, log.InfoLevel, "after", nil, 10)
+	s.Close()
+	api.Close()
+}
+
+func TestLogFollowersAreCapped(t *testing.T) {
+	s := newStreamServer(t)
+	defer s.Close()
+	w := s.worker()
+	for i := 0; i < maxLogFollowers; i++ {
+		if !w.followLogs() {
+			t.Fatalf("Follower %d was turned away.", i)
+		}
+	}
+	res := httptest.NewRecorder()
+	w.handleLogs(res, httptest.NewRequest(http.MethodGet, "/logs?key=TestCluster:Threads:busy&follow=true", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Follower over the cap was served, status %d", res.Code)
+	}
+	if w.logTailClient() == w.Client {
+		t.Errorf("Followers share the worker's client.")
+	}
+}
+
+func TestScriptLogIsTagged(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	tm := &ThreadMeta{Key: "TestCluster:Threads:logger", vm: otto.New()}
+	applyLibrary(w, tm)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	if _, err := tm.vm.Run(`log.warn("disk low", {free: 10})`); err != nil {
+		t.Fatalf("Script failed: %v", err)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &line); err != nil {
+		t.Fatalf("Log line is not JSON: %v", err)
+	}
+	if line["msg"] != "disk low" || line["level"] != "warning" || line["free"] != float64(10) {
+		t.Errorf("Unexpected log line %v", line)
+	}
+	if line["cluster"] != "TestCluster" || line["worker"] != "worker" || line["task"] != tm.Key {
+		t.Errorf("Log line is not tagged %v", line)
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	w.metrics.add("hats_endpoint_requests_total", "Requests served by endpoints.", 1, "task", `a"b`, "status", "200")
+	w.metrics.observe("hats_job_duration_seconds", "Time taken by job runs.", 20*time.Millisecond, "task", "job")
+
+	recorder := httptest.NewRecorder()
+	w.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"hats_worker_healthy 1",
+		"hats_worker_threads_owned 0",
+		`hats_endpoint_requests_total{task="a\"b",status="200"} 1`,
+		`hats_job_duration_seconds_bucket{task="job",le="0.01"} 0`,
+		`hats_job_duration_seconds_bucket{task="job",le="0.025"} 1`,
+		`hats_job_duration_seconds_bucket{task="job",le="+Inf"} 1`,
+		`hats_job_duration_seconds_count{task="job"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics are missing %q", line)
+		}
+	}
+}
+
+func TestEndpointStatusIsCounted(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	key := "TestCluster:Endpoints:/missing"
+	mr.HSet(key, "Source", `<? response.Error("nope", 404) ?>`)
+
+	w.handleEndpoint(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	recorder := httptest.NewRecorder()
+	w.metrics.write(recorder)
+	if !strings.Contains(recorder.Body.String(), `hats_endpoint_requests_total{task="`+key+`",status="404"} 1`) {
+		t.Errorf("Endpoint status was not counted:\n%s", recorder.Body.String())
+	}
+}
+
+func TestScriptMetricsFollowTheTask(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	key := "TestCluster:Jobs:billing"
+	first := newTestWorker(mr, "first")
+	second := newTestWorker(mr, "second")
+	Elect(first)
+
+	script := `
+		metrics.counter("items_processed_total", "Items processed").add(2, {queue: "a"});
+		metrics.gauge("queue_depth").set(7);
+		metrics.histogram("fetch_seconds", "Fetch time", [0.5, 1]).observe(0.75);
+	`
+	tm := &ThreadMeta{Key: key, vm: otto.New()}
+	applyLibrary(first, tm)
+	if _, err := tm.vm.Run(script); err != nil {
+		t.Fatalf("Script failed: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	first.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE items_processed_total counter",
+		`items_processed_total{task="` + key + `",queue="a"} 2`,
+		`queue_depth{task="` + key + `"} 7`,
+		`fetch_seconds_bucket{task="` + key + `",le="0.5"} 0`,
+		`fetch_seconds_bucket{task="` + key + `",le="1"} 1`,
+		`fetch_seconds_count{task="` + key + `"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics are missing %q:\n%s", line, body)
+		}
+	}
+	if strings.Index(body, `le="0.5"`) > strings.Index(body, `le="+Inf"`) {
+		t.Errorf("Buckets are out of order:\n%s", body)
+	}
+
+	//The task runs on another worker too, which carries on counting while the
+	//leader keeps exporting.
+	tm = &ThreadMeta{Key: key, vm: otto.New()}
+	applyLibrary(second, tm)
+	if _, err := tm.vm.Run(`metrics.counter("items_processed_total").inc({queue: "a"})`); err != nil {
+		t.Fatalf("Script failed: %v", err)
+	}
+	recorder = httptest.NewRecorder()
+	first.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `items_processed_total{task="`+key+`",queue="a"} 3`) {
+		t.Errorf("Counter did not carry on:\n%s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	second.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(recorder.Body.String(), "items_processed_total") {
+		t.Errorf("A worker that isn't leader exports the task's metrics.")
+	}
+
+	if _, err := tm.vm.Run(`metrics.gauge("items_processed_total")`); err == nil {
+		t.Errorf("Redefining a metric as another type should fail.")
+	}
+}
+
+func TestScriptMetricNameKeepsOneTypeAcrossTasks(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	Elect(w)
+	counting := &ThreadMeta{Key: "TestCluster:Jobs:counting", vm: otto.New()}
+	applyLibrary(w, counting)
+	if _, err := counting.vm.Run(`metrics.counter("items_total").inc()`); err != nil {
+		t.Fatalf("Script failed: %v", err)
+	}
+	gauging := &ThreadMeta{Key: "TestCluster:Jobs:gauging", vm: otto.New()}
+	applyLibrary(w, gauging)
+	if _, err := gauging.vm.Run(`metrics.gauge("items_total")`); err == nil {
+		t.Errorf("Another task redefined a metric as another type.")
+	}
+
+	//Definitions written before names were checked across tasks.
+	mr.HSet(scriptMetricsKey(gauging.Key), "items_total", `{"Type":"gauge","Help":"items_total"}`)
+	mr.HSet(scriptMetricValuesKey(gauging.Key), `items_total{task="`+gauging.Key+`"}`, "5")
+	mr.SetAdd(scriptMetricTasksKey(w), gauging.Key)
+	recorder := httptest.NewRecorder()
+	w.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	if strings.Count(body, "# TYPE items_total") != 1 || strings.Contains(body, gauging.Key) {
+		t.Errorf("Conflicting definitions were both exported:\n%s", body)
+	}
+}
+
+func TestReadinessAndStatus(t *testing.T) {
+	mr, _ := miniredis.Run()
+	defer mr.Close()
+	w := newTestWorker(mr, "worker")
+	w.started = time.Now()
+	w.threads = map[string]*ThreadMeta{"TestCluster:Threads:a": {Key: "TestCluster:Threads:a", version: "v1"},
+		"TestCluster:Threads:b": {Key: "TestCluster:Threads:b", Stopped: true}}
+
+	recorder := httptest.NewRecorder()
+	w.handleReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Healthy worker is not ready: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	w.handleStatus(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status workerStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Status is not JSON: %v", err)
+	}
+	if !status.Ready || status.Worker != "worker" || len(status.Threads) != 1 || status.Threads[0].Version != "v1" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	w.Healthy = false
+	recorder = httptest.NewRecorder()
+	w.handleReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unhealthy worker is ready.")
+	}
+	w.Healthy = true
+	w.shuttingDown = true
+	recorder = httptest.NewRecorder()
+	w.handleReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Draining worker is ready.")
+	}
+	w.shuttingDown = false
+
+	mr.Close()
+	recorder = httptest.NewRecorder()
+	w.handleReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Worker without redis is ready.")
+	}
+	recorder = httptest.NewRecorder()
+	w.handleHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Worker without redis is not alive.")
+	}
+}